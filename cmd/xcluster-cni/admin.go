@@ -0,0 +1,193 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// maxSyncDuration A sync that takes longer is considered hanging
+const maxSyncDuration = time.Minute * 2
+
+// adminServer An HTTP server for probes, metrics and debugging.
+// Endpoints;
+//
+//	/healthz     - The syncers are alive and the node informer is synced
+//	/readyz      - All networks have made a successful sync
+//	/metrics     - Prometheus metrics
+//	/debug/state - The state of all networks as JSON
+type adminServer struct {
+	nw *networks
+}
+
+// start Start serving on the address until the context is cancelled
+func (a *adminServer) start(ctx context.Context, address string) error {
+	logger := logr.FromContextOrDiscard(ctx).WithName("Admin")
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, a.nw.health())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, a.nw.ready())
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(a.nw.state(logr.NewContext(r.Context(), logger)))
+	})
+	srv := http.Server{Handler: mux, ReadHeaderTimeout: time.Second * 5}
+	go func() {
+		<-ctx.Done()
+		toctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(toctx)
+	}()
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			logger.Error(err, "Serve")
+		}
+	}()
+	logger.Info("Serving", "address", l.Addr().String())
+	return nil
+}
+
+// respond Respond "ok", or 503 (Service Unavailable) with the error
+func respond(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// health Returns an error if the node informer isn't synced, or if the
+// syncer of a network has terminated or hangs
+func (nw *networks) health() error {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	if nw.h == nil || !nw.h.HasSynced() {
+		return fmt.Errorf("Node informer not synced")
+	}
+	for name, n := range nw.items {
+		select {
+		case <-n.syncer.done:
+			return fmt.Errorf("Syncer terminated, network %s", name)
+		default:
+		}
+		n.syncer.mu.Lock()
+		busy := n.syncer.busy
+		n.syncer.mu.Unlock()
+		if !busy.IsZero() && time.Since(busy) > maxSyncDuration {
+			return fmt.Errorf("Sync hangs since %s, network %s",
+				busy.Format(time.RFC3339), name)
+		}
+	}
+	return nil
+}
+
+// ready Returns an error if a network in the config hasn't made a
+// successful sync, e.g. if it failed to start, or if there are no
+// networks, e.g. before any XclusterNetwork object is created
+func (nw *networks) ready() error {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	if len(nw.wanted) == 0 {
+		return fmt.Errorf("No networks")
+	}
+	for _, name := range nw.wanted {
+		if err, ok := nw.failed[name]; ok {
+			return fmt.Errorf("Start failed, network %s: %w", name, err)
+		}
+		n, ok := nw.items[name]
+		if !ok {
+			return fmt.Errorf("Not started, network %s", name)
+		}
+		n.syncer.mu.Lock()
+		synced := n.syncer.synced
+		n.syncer.mu.Unlock()
+		if !synced {
+			return fmt.Errorf("Not synced, network %s", name)
+		}
+	}
+	return nil
+}
+
+// networkState The state of a network, for debugging
+type networkState struct {
+	Name     string        `json:"name"`
+	LastSync *time.Time    `json:"lastSync,omitempty"`
+	Wanted   []util.Route  `json:"wanted"`
+	Kernel   []util.Route  `json:"kernel"`
+	Problems []nodeProblem `json:"problems,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// state Returns the state of all networks, sorted by name. The wanted
+// routes and problems are from the last sync, and the kernel routes
+// are read now
+func (nw *networks) state(ctx context.Context) []networkState {
+	nw.mu.Lock()
+	items := make([]*network, 0, len(nw.items))
+	for _, n := range nw.items {
+		items = append(items, n)
+	}
+	nw.mu.Unlock()
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].config.Name < items[j].config.Name
+	})
+	states := make([]networkState, 0, len(items))
+	for _, n := range items {
+		st := networkState{Name: n.config.Name}
+		n.syncer.mu.Lock()
+		if !n.syncer.lastTime.IsZero() {
+			t := n.syncer.lastTime
+			st.LastSync = &t
+		}
+		if last := n.syncer.last; last != nil {
+			st.Wanted = sortedRoutes(last.want)
+			st.Problems = last.Problems
+		}
+		n.syncer.mu.Unlock()
+		kernel, err := n.syncer.sh.rh.GetRoutes(ctx)
+		if err != nil {
+			st.Error = err.Error()
+		}
+		sort.Slice(kernel, func(i, j int) bool {
+			return kernel[i].Dst < kernel[j].Dst
+		})
+		st.Kernel = kernel
+		states = append(states, st)
+	}
+	return states
+}
+
+// sortedRoutes Returns the routes sorted on Dst
+func sortedRoutes(routes map[string]util.Route) []util.Route {
+	sorted := make([]util.Route, 0, len(routes))
+	for _, r := range routes {
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Dst < sorted[j].Dst
+	})
+	return sorted
+}
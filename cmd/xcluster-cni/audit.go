@@ -0,0 +1,200 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// reasonOutsideSupernet A reason for audit findings, in addition to
+// the node problem reasons
+const reasonOutsideSupernet = "OutsideSupernet"
+
+// cmdAudit Check the routing inputs of all nodes for one or more
+// networks. Exits with 1 if any problem is found.
+func cmdAudit(ctx context.Context, args []string) int {
+	flagset := flag.NewFlagSet("audit", flag.ExitOnError)
+	flagset.Usage = func() {
+		fmt.Fprintf(flagset.Output(), `Syntax: audit [options]
+
+  Check the Node objects for problems that prevent routing, e.g.
+  missing addresses or CIDRs, family mismatches, overlapping CIDRs,
+  unparseable annotations and CIDRs outside the expected double-dash
+  supernets ("allocateCidrs" or -supernets). Exits with 1 if any
+  problem is found.
+
+`)
+		flagset.PrintDefaults()
+	}
+	nodesFile := flagset.String("nodes", "", "File with Node objects. Default is to read from K8s")
+	output := flagset.String("o", "table", "Output format; table|json")
+	supernets := flagset.String("supernets", "",
+		"Comma separated double-dash CIDRs. Overrides allocateCidrs")
+	nf := addNetworkFlags(flagset)
+	if err := flagset.Parse(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid output format %s\n", *output)
+		return 1
+	}
+	networks, err := nf.networks()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *supernets != "" {
+		for i := range networks {
+			networks[i].AllocateCidrs = strings.Split(*supernets, ",")
+		}
+	}
+	nodes, err := loadNodes(ctx, *nodesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx = logr.NewContext(ctx, logr.Discard()) // Findings are printed
+	var findings []auditFinding
+	for i := range networks {
+		f, err := audit(ctx, &networks[i], nodes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Network %s: %v\n", networks[i].Name, err)
+			return 1
+		}
+		findings = append(findings, f...)
+	}
+	if *output == "json" {
+		if findings == nil {
+			findings = []auditFinding{}
+		}
+		util.EmitJson(findings)
+	} else {
+		printFindings(os.Stdout, findings)
+	}
+	if len(findings) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// auditFinding A problem found by audit
+type auditFinding struct {
+	Network string `json:"network"`
+	Node    string `json:"node"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// audit Returns the problems for a network, sorted on node and reason.
+// The routes are computed as by a sync on a node outside the cluster,
+// so all nodes are checked
+func audit(ctx context.Context,
+	n *networkConfig, nodes []k8s.Node) ([]auditFinding, error) {
+	sh, err := newOfflineSyncHandler(n)
+	if err != nil {
+		return nil, err
+	}
+	nodes = sh.networkNodes(nodes)
+	var result syncResult
+	_ = sh.computeRoutes(ctx, nodes, "", &result)
+
+	var findings []auditFinding
+	add := func(node, reason, message string) {
+		findings = append(findings, auditFinding{
+			Network: n.Name, Node: node, Reason: reason, Message: message})
+	}
+	for _, p := range result.Problems {
+		add(p.Node, p.Reason, p.Message)
+	}
+	for _, node := range nodes {
+		name := node.ObjectMeta.Name
+		if len(n.AllocateCidrs) == 0 {
+			continue
+		}
+		for _, c := range sh.podCidrs(&node) {
+			if _, family := canonicalCidr(c); family == 0 {
+				continue // Already reported
+			}
+			if !inSupernet(n.AllocateCidrs, c) {
+				add(name, reasonOutsideSupernet, fmt.Sprintf(
+					"CIDR %s is not a node CIDR in %s",
+					c, strings.Join(n.AllocateCidrs, ",")))
+			}
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Node != findings[j].Node {
+			return findings[i].Node < findings[j].Node
+		}
+		return findings[i].Reason < findings[j].Reason
+	})
+	return findings, nil
+}
+
+// inSupernet Returns true if the CIDR is a node CIDR in any of the
+// double-dash CIDRs, or if there are no double-dash CIDRs of the same
+// family
+func inSupernet(doubleDashCIDRs []string, cidr string) bool {
+	_, family := canonicalCidr(cidr)
+	checked := false
+	for _, dd := range doubleDashCIDRs {
+		base, _, _ := strings.Cut(dd, "/")
+		if ip := net.ParseIP(base); ip == nil || (ip.To4() != nil) != (family == 4) {
+			continue
+		}
+		checked = true
+		if _, err := util.CIDRNumber(dd, cidr); err == nil {
+			return true
+		}
+	}
+	return !checked
+}
+
+// printFindings Print findings as a table
+func printFindings(out io.Writer, findings []auditFinding) {
+	if len(findings) == 0 {
+		fmt.Fprintln(out, "No problems found")
+		return
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NETWORK\tNODE\tREASON\tMESSAGE")
+	for _, f := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Network, f.Node, f.Reason, f.Message)
+	}
+	w.Flush()
+}
+
+// loadNodes Read nodes from a file, or list them from K8s if the file
+// is empty
+func loadNodes(ctx context.Context, file string) ([]k8s.Node, error) {
+	if file != "" {
+		return readNodes(file)
+	}
+	clientset, err := util.GetClientset()
+	if err != nil {
+		return nil, err
+	}
+	list, err := clientset.CoreV1().Nodes().List(ctx, meta.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
@@ -0,0 +1,166 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// conditionType The NodeCondition type for the default network.
+// Other networks has the network name appended
+const conditionType = "XclusterCniRoutesReady"
+
+// conditionInterval A condition that is unchanged, except for the time
+// of the last successful sync, is not written more often than this
+const conditionInterval = time.Minute * 5
+
+// nodeCondition Maintains a NodeCondition per network in the status
+// of the own Node object
+type nodeCondition struct {
+	client kubernetes.Interface
+	node   string
+	mu     sync.Mutex
+	state  map[string]*conditionState
+}
+
+// conditionState The last written condition of a network
+type conditionState struct {
+	status      k8s.ConditionStatus
+	reason      string
+	summary     string // The message without time
+	transition  meta.Time
+	lastSuccess time.Time
+	written     time.Time
+}
+
+// networkConditionType Returns the condition type of a network
+func networkConditionType(network string) k8s.NodeConditionType {
+	if network == defaultNetwork {
+		return conditionType
+	}
+	return k8s.NodeConditionType(conditionType + "-" + network)
+}
+
+// report A syncReporter that updates the condition of the network.
+// The condition is True if the sync succeeded without failures
+func (c *nodeCondition) report(
+	ctx context.Context, network string, result *syncResult, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == nil {
+		c.state = make(map[string]*conditionState)
+	}
+	st, ok := c.state[network]
+	if !ok {
+		st = &conditionState{}
+		c.state[network] = st
+	}
+	now := time.Now()
+	status := k8s.ConditionFalse
+	var reason, summary string
+	switch {
+	case err != nil:
+		reason = "SyncFailed"
+		summary = err.Error()
+	case len(result.Failures) > 0:
+		reason = "RouteFailures"
+		summary = fmt.Sprintf("%d routes, %d failures", result.Routes, len(result.Failures))
+	case result.Refused > 0:
+		reason = "DeleteRefused"
+		summary = fmt.Sprintf("%d routes, %d deletions refused", result.Routes, result.Refused)
+	default:
+		status = k8s.ConditionTrue
+		reason = "RoutesSynced"
+		summary = fmt.Sprintf("%d routes, 0 failures", result.Routes)
+		st.lastSuccess = now
+	}
+	if status == st.status && reason == st.reason && summary == st.summary &&
+		now.Sub(st.written) < conditionInterval {
+		return
+	}
+	transition := st.transition
+	if status != st.status {
+		transition = meta.NewTime(now)
+	}
+	message := summary + ", no successful sync"
+	if !st.lastSuccess.IsZero() {
+		message = fmt.Sprintf("%s, last successful sync %s",
+			summary, st.lastSuccess.UTC().Format(time.RFC3339))
+	}
+	cond := k8s.NodeCondition{
+		Type:               networkConditionType(network),
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastHeartbeatTime:  meta.NewTime(now),
+		LastTransitionTime: transition,
+	}
+	if err := c.write(ctx, &cond); err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "Write node condition")
+		return
+	}
+	st.status = status
+	st.reason = reason
+	st.summary = summary
+	st.transition = transition
+	st.written = now
+}
+
+// remove Remove the condition of a network that is removed from the
+// config
+func (c *nodeCondition) remove(ctx context.Context, network string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.state[network]; !ok {
+		return // Never reported
+	}
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []map[string]interface{}{
+				{"type": networkConditionType(network), "$patch": "delete"},
+			},
+		},
+	}
+	if err := c.patch(ctx, patch); err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "Remove node condition")
+		return
+	}
+	delete(c.state, network)
+}
+
+// write Strategic-merge-patch the condition in the node status.
+// Conditions are merged on type, so other conditions are not affected
+func (c *nodeCondition) write(ctx context.Context, cond *k8s.NodeCondition) error {
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []*k8s.NodeCondition{cond},
+		},
+	}
+	return c.patch(ctx, patch)
+}
+
+// patch Strategic-merge-patch the node status
+func (c *nodeCondition) patch(ctx context.Context, patch interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	toctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	_, err = c.client.CoreV1().Nodes().Patch(
+		toctx, c.node, types.StrategicMergePatchType, data, meta.PatchOptions{}, "status")
+	return err
+}
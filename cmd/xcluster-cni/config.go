@@ -0,0 +1,317 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// daemonConfig The daemon configuration file. The format is YAML or
+// JSON. Example;
+//
+//	networks:
+//	  - name: net3
+//	    protocol: "200"
+//	    cidrAnnotation: cidr.example.com/net3
+//	    addressAnnotation: adr.example.com/net3
+//	  - name: net4
+//	    protocol: "201"
+//	    table: 201
+//	    cidrAnnotation: cidr.example.com/net4
+//	    addressAnnotation: adr.example.com/net4
+type daemonConfig struct {
+	Networks []networkConfig `json:"networks"`
+}
+
+// networkConfig The configuration of one network. Fields correspond
+// to the environment variables used when no config file is given
+type networkConfig struct {
+	Name                 string   `json:"name"`
+	Protocol             string   `json:"protocol,omitempty"`
+	CidrAnnotation       string   `json:"cidrAnnotation,omitempty"`
+	AddressAnnotation    string   `json:"addressAnnotation,omitempty"`
+	Table                int      `json:"table,omitempty"`
+	RouteHandler         string   `json:"routeHandler,omitempty"`
+	RulePriority         int      `json:"rulePriority,omitempty"`
+	Vrf                  string   `json:"vrf,omitempty"`
+	VrfInterfaces        []string `json:"vrfInterfaces,omitempty"`
+	RouteSrc             string   `json:"routeSrc,omitempty"`
+	RouteMetric          int      `json:"routeMetric,omitempty"`
+	RouteMTU             int      `json:"routeMtu,omitempty"`
+	OwnCidrRoute         string   `json:"ownCidrRoute,omitempty"`
+	DeleteGuardShare     int      `json:"deleteGuardShare,omitempty"`
+	DeleteGuardMinRoutes int      `json:"deleteGuardMinRoutes,omitempty"`
+	DeleteGuardPeriod    string   `json:"deleteGuardPeriod,omitempty"`
+	DeleteGuardOverride  string   `json:"deleteGuardOverride,omitempty"`
+	// NodeSelector Only nodes with matching labels are part of the
+	// network. Default is all nodes
+	NodeSelector *meta.LabelSelector `json:"nodeSelector,omitempty"`
+	// AddressInterface and AddressSubnets selects local addresses
+	// that are published in the AddressAnnotation of the own node
+	AddressInterface string   `json:"addressInterface,omitempty"`
+	AddressSubnets   []string `json:"addressSubnets,omitempty"`
+	// AllocateCidrs "Double-dash" CIDRs, e.g. "192.168.0.0/16/24",
+	// from which the controller allocates CIDRs for the nodes and
+	// writes them in the CidrAnnotation. Not used by the daemon
+	AllocateCidrs []string `json:"allocateCidrs,omitempty"`
+}
+
+// defaultProtocol The route protocol if none is specified
+const defaultProtocol = "202"
+
+// defaultNetwork The name of the network defined by environment
+// variables
+const defaultNetwork = "default"
+
+// readConfig Read and validate a config file
+func readConfig(file string) (*daemonConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+// parseConfig Parse and validate a config in YAML or JSON format.
+// Defaults are set
+func parseConfig(data []byte) (*daemonConfig, error) {
+	var cfg daemonConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, err
+	}
+	var nv networkValidator
+	for i := range cfg.Networks {
+		if err := nv.check(&cfg.Networks[i]); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
+
+// networkValidator Validates networks and checks that names and
+// protocols are unique among the checked networks
+type networkValidator struct {
+	names     map[string]bool
+	protocols map[string]string
+}
+
+// check Set defaults and validate a network. Names and protocols of
+// accepted networks are recorded
+func (nv *networkValidator) check(n *networkConfig) error {
+	if nv.names == nil {
+		nv.names = make(map[string]bool)
+		nv.protocols = make(map[string]string)
+	}
+	if n.Protocol == "" {
+		n.Protocol = defaultProtocol
+	}
+	if n.Name == "" {
+		return fmt.Errorf("Network without name")
+	}
+	if nv.names[n.Name] {
+		return fmt.Errorf("Duplicate network %s", n.Name)
+	}
+	// Routes are handled by protocol, so it must be unique
+	if other, ok := nv.protocols[n.Protocol]; ok {
+		return fmt.Errorf(
+			"Networks %s and %s has the same protocol %s",
+			other, n.Name, n.Protocol)
+	}
+	if err := n.validate(); err != nil {
+		return fmt.Errorf("Network %s: %w", n.Name, err)
+	}
+	nv.names[n.Name] = true
+	nv.protocols[n.Protocol] = n.Name
+	return nil
+}
+
+// envConfig Returns a config with one network defined by environment
+// variables
+func envConfig() (*daemonConfig, error) {
+	n := networkConfig{
+		Name:                defaultNetwork,
+		Protocol:            os.Getenv("PROTOCOL"),
+		CidrAnnotation:      os.Getenv("CIDR_ANNOTATION"),
+		AddressAnnotation:   os.Getenv("ADDRESS_ANNOTATION"),
+		RouteHandler:        os.Getenv("ROUTE_HANDLER"),
+		Vrf:                 os.Getenv("VRF"),
+		RouteSrc:            os.Getenv("ROUTE_SRC"),
+		OwnCidrRoute:        os.Getenv("OWN_CIDR_ROUTE"),
+		DeleteGuardPeriod:   os.Getenv("DELETE_GUARD_PERIOD"),
+		DeleteGuardOverride: os.Getenv("DELETE_GUARD_OVERRIDE"),
+	}
+	if n.Protocol == "" {
+		n.Protocol = defaultProtocol
+	}
+	if i := os.Getenv("VRF_INTERFACES"); i != "" {
+		n.VrfInterfaces = strings.Split(i, ",")
+	}
+	n.AddressInterface = os.Getenv("ADDRESS_INTERFACE")
+	if i := os.Getenv("ADDRESS_SUBNETS"); i != "" {
+		n.AddressSubnets = strings.Split(i, ",")
+	}
+	if i := os.Getenv("ALLOCATE_CIDRS"); i != "" {
+		n.AllocateCidrs = strings.Split(i, ",")
+	}
+	ints := []struct {
+		name  string
+		value *int
+	}{
+		{"ROUTE_TABLE", &n.Table},
+		{"RULE_PRIORITY", &n.RulePriority},
+		{"ROUTE_METRIC", &n.RouteMetric},
+		{"ROUTE_MTU", &n.RouteMTU},
+		{"DELETE_GUARD_SHARE", &n.DeleteGuardShare},
+		{"DELETE_GUARD_MIN_ROUTES", &n.DeleteGuardMinRoutes},
+	}
+	for _, i := range ints {
+		v, err := intEnv(i.name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", i.name, err)
+		}
+		*i.value = v
+	}
+	if err := n.validate(); err != nil {
+		return nil, err
+	}
+	return &daemonConfig{Networks: []networkConfig{n}}, nil
+}
+
+// validate Check the network configuration without creating anything
+func (n *networkConfig) validate() error {
+	if n.Vrf != "" && n.Table == 0 {
+		return fmt.Errorf("A table must be set for VRF %s", n.Vrf)
+	}
+	if err := checkRouteSrc(n.RouteSrc); err != nil {
+		return err
+	}
+	if !util.ValidRouteType(n.OwnCidrRoute) {
+		return fmt.Errorf("Invalid own CIDR route %s", n.OwnCidrRoute)
+	}
+	if n.OwnCidrRoute != "" && n.Table != 0 && n.Vrf == "" {
+		// Traffic from own PODs would be directed to the table
+		// and hit the route, also for local destinations
+		return fmt.Errorf("Own CIDR route can't be used with policy rules")
+	}
+	if n.DeleteGuardShare < 0 || n.DeleteGuardShare > 100 {
+		return fmt.Errorf("Invalid delete guard share %d", n.DeleteGuardShare)
+	}
+	if n.DeleteGuardMinRoutes < 0 {
+		return fmt.Errorf("Invalid delete guard min routes %d", n.DeleteGuardMinRoutes)
+	}
+	if n.DeleteGuardPeriod != "" {
+		if _, err := time.ParseDuration(n.DeleteGuardPeriod); err != nil {
+			return err
+		}
+	}
+	if n.NodeSelector != nil {
+		if _, err := meta.LabelSelectorAsSelector(n.NodeSelector); err != nil {
+			return err
+		}
+	}
+	if n.publishAddresses() && n.AddressAnnotation == "" {
+		return fmt.Errorf("An address annotation is needed to publish addresses")
+	}
+	for _, c := range n.AddressSubnets {
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			return err
+		}
+	}
+	if len(n.AllocateCidrs) > 0 && n.CidrAnnotation == "" {
+		return fmt.Errorf("A CIDR annotation is needed to allocate CIDRs")
+	}
+	for _, c := range n.AllocateCidrs {
+		if _, err := util.CreateCIDR(c, 0); err != nil {
+			return fmt.Errorf("Allocate CIDR %s: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// publishAddresses Returns true if local addresses shall be published
+// in the address annotation of the own node
+func (n *networkConfig) publishAddresses() bool {
+	return n.AddressInterface != "" || len(n.AddressSubnets) > 0
+}
+
+// newSyncHandler Create a syncHandler for the network. Route and rule
+// handlers are created
+func newSyncHandler(
+	ctx context.Context, n *networkConfig, dryRun bool) (*syncHandler, error) {
+	sh, err := newOfflineSyncHandler(n)
+	if err != nil {
+		return nil, err
+	}
+	sh.localAddress = nil
+	sh.dryRun = dryRun
+	if sh.rh, sh.ruh, err = newHandlers(
+		ctx, n.RouteHandler, n.Protocol, n.Table, n.Vrf, n.RulePriority); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// newOfflineSyncHandler Create a syncHandler for the network without
+// route and rule handlers. It can only compute routes, and never
+// access the kernel, so "auto" route source addresses are not set
+func newOfflineSyncHandler(n *networkConfig) (*syncHandler, error) {
+	sh := syncHandler{
+		protocol:          n.Protocol,
+		cidrAnnotation:    n.CidrAnnotation,
+		addressAnnotation: n.AddressAnnotation,
+		src:               n.RouteSrc,
+		metric:            n.RouteMetric,
+		mtu:               n.RouteMTU,
+		vrf:               n.Vrf,
+		vrfTable:          n.Table,
+		vrfInterfaces:     n.VrfInterfaces,
+		ownCidrRoute:      n.OwnCidrRoute,
+		localAddress: func(ip string) (string, error) {
+			return "", fmt.Errorf("Local addresses unknown offline")
+		},
+	}
+	var err error
+	if n.NodeSelector != nil {
+		if sh.nodeSelector, err = meta.LabelSelectorAsSelector(n.NodeSelector); err != nil {
+			return nil, err
+		}
+	}
+	sh.deleteGuard.share = n.DeleteGuardShare
+	sh.deleteGuard.minRoutes = n.DeleteGuardMinRoutes
+	if n.DeleteGuardPeriod != "" {
+		if sh.deleteGuard.period, err = time.ParseDuration(n.DeleteGuardPeriod); err != nil {
+			return nil, err
+		}
+	}
+	sh.deleteGuard.override = n.DeleteGuardOverride
+	if sh.deleteGuard.override == "" {
+		sh.deleteGuard.override = defaultDeleteGuardOverride
+		if n.Name != defaultNetwork {
+			sh.deleteGuard.override += "-" + n.Name
+		}
+	}
+	return &sh, nil
+}
+
+// intEnv Returns the value of an integer environment variable, or 0
+// (zero) if it is unset
+func intEnv(name string) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
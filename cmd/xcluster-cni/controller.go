@@ -0,0 +1,497 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	klog "k8s.io/klog/v2"
+)
+
+// cmdController The controller allocates a unique number to each K8s
+// node and writes CIDRs, created from "double-dash" CIDRs with the
+// number, in the CIDR annotation of the node. Allocations are stored
+// in a ConfigMap. Several instances may run, but only the leader
+// allocates.
+func cmdController(ctx context.Context, args []string) int {
+	logger := logr.FromContextOrDiscard(ctx)
+	klog.SetLogger(logger) // Use our logger for K8s logging
+
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "kube-system"
+	}
+	flagset := flag.NewFlagSet("controller", flag.ExitOnError)
+	configFile := flagset.String("config", os.Getenv("CONFIG_FILE"),
+		"Config file with networks")
+	flagset.StringVar(&namespace, "namespace", namespace,
+		"Namespace for the allocations ConfigMap and the Lease")
+	allocations := flagset.String("allocations", defaultAllocations,
+		"ConfigMap where allocations are stored")
+	lease := flagset.String("lease", defaultControllerLease,
+		"Lease used for leader election")
+	identity := flagset.String("identity", os.Getenv("POD_NAME"),
+		"Leader election identity. Default is the hostname")
+	releaseGrace := flagset.Duration("release-grace", defaultReleaseGrace,
+		"Time before the number of a deleted node is reused")
+	if err := flagset.Parse(args[1:]); err != nil {
+		logger.Error(err, "Parse options")
+		return 1
+	}
+
+	var cfg *daemonConfig
+	var err error
+	if *configFile != "" {
+		cfg, err = readConfig(*configFile)
+	} else {
+		cfg, err = envConfig()
+	}
+	if err != nil {
+		logger.Error(err, "Config", "file", *configFile)
+		return 1
+	}
+	a := nodeAllocator{
+		namespace:    namespace,
+		name:         *allocations,
+		releaseGrace: *releaseGrace,
+	}
+	for _, n := range cfg.Networks {
+		if len(n.AllocateCidrs) > 0 {
+			a.networks = append(a.networks, n)
+		}
+	}
+	if len(a.networks) == 0 {
+		logger.Info("No networks with CIDRs to allocate")
+		return 1
+	}
+	if *identity == "" {
+		if *identity, err = os.Hostname(); err != nil {
+			logger.Error(err, "Hostname")
+			return 1
+		}
+	}
+	clientset, err := util.GetClientset()
+	if err != nil {
+		logger.Error(err, "GetClientset")
+		return 1
+	}
+	a.client = clientset
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: meta.ObjectMeta{Name: *lease, Namespace: namespace},
+		Client:    clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: *identity,
+		},
+	}
+	logger.Info("Xcluster-cni controller started",
+		"identity", *identity, "lease", *lease, "allocations", *allocations)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logger.Info("Started leading")
+				a.run(ctx, clientset)
+			},
+			OnStoppedLeading: func() {
+				logger.Info("Stopped leading")
+			},
+		},
+	})
+	if ctx.Err() != nil {
+		logger.Error(ctx.Err(), "Xcluster-cni controller terminating")
+		return 0
+	}
+	// Leadership is lost. Terminate, and let K8s restart us, since
+	// the new leader may change the allocations
+	return 1
+}
+
+// defaultAllocations The name of the ConfigMap with allocations
+const defaultAllocations = "xcluster-cni-allocations"
+
+// defaultControllerLease The name of the Lease for leader election
+const defaultControllerLease = "xcluster-cni-controller"
+
+// allocationRetryDelay The delay before a failed reconcile is retried
+const allocationRetryDelay = time.Second * 10
+
+// defaultReleaseGrace The default time before the number of a deleted
+// node is reused. Until then, routes to the old CIDRs may remain on
+// some nodes
+const defaultReleaseGrace = time.Minute * 10
+
+// releasedPrefix The key prefix for released numbers in the
+// ConfigMap. Node names can't contain "_"
+const releasedPrefix = "released_"
+
+// nodeAllocator Allocates a number to each node and writes the CIDRs
+// of the networks in the node annotations. The allocations, node name
+// to number, are stored in a ConfigMap so they survive restarts and
+// leader changes
+type nodeAllocator struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string // The ConfigMap
+	networks  []networkConfig
+	// allocations nil until loaded from the ConfigMap
+	allocations map[string]uint
+	// released Numbers of deleted nodes, and the time they were
+	// released. They are not reused within releaseGrace
+	released     map[uint]time.Time
+	releaseGrace time.Duration
+	cm           *k8s.ConfigMap
+}
+
+// run Watch nodes and reconcile on any update until the context is
+// cancelled, i.e. when the leadership is lost
+func (a *nodeAllocator) run(ctx context.Context, clientset *kubernetes.Clientset) {
+	logger := logr.FromContextOrDiscard(ctx)
+	// The capacity is just one, and non-blocking sending is used,
+	// to coalesce node updates
+	ch := make(chan struct{}, 1)
+	trig := func() {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	funcs := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			trig()
+		},
+		DeleteFunc: func(obj interface{}) {
+			trig()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			trig()
+		},
+	}
+	h, err := util.CreateNodeHandler(ctx, clientset, &funcs)
+	if err != nil {
+		logger.Error(err, "CreateNodeHandler")
+		return
+	}
+	if s, ok := h.(util.Stopper); ok {
+		// Stop watching nodes when the leadership is lost
+		defer s.Stop()
+	}
+	trig()
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ch:
+		case <-retry:
+		case <-ctx.Done():
+			return
+		}
+		retry = nil
+		nodeList := h.List()
+		nodes := make([]k8s.Node, len(nodeList))
+		for i := range nodeList {
+			nodes[i] = *nodeList[i].(*k8s.Node)
+		}
+		if err := a.reconcile(ctx, nodes); err != nil {
+			logger.Error(err, "Reconcile", "retry", allocationRetryDelay)
+			retry = time.After(allocationRetryDelay)
+		}
+	}
+}
+
+// reconcile Allocate numbers to new nodes and release numbers of
+// deleted nodes. The allocations are stored before any node is
+// annotated, so an allocated CIDR is never lost
+func (a *nodeAllocator) reconcile(ctx context.Context, nodes []k8s.Node) error {
+	logger := logr.FromContextOrDiscard(ctx)
+	if a.allocations == nil {
+		if err := a.load(ctx); err != nil {
+			return err
+		}
+	}
+	alloc, released := a.allocate(ctx, nodes)
+	if !reflect.DeepEqual(alloc, a.allocations) ||
+		!reflect.DeepEqual(released, a.released) {
+		if err := a.store(ctx, alloc, released); err != nil {
+			// Re-read on next reconcile, the ConfigMap may have
+			// been updated by someone else
+			a.allocations = nil
+			return err
+		}
+		logger.Info("Allocations stored", "nodes", len(alloc))
+	}
+	a.allocations = alloc
+	a.released = released
+
+	var firstErr error
+	for _, n := range nodes {
+		no, ok := alloc[n.Name]
+		if !ok {
+			continue
+		}
+		annotations := make(map[string]string)
+		for k, v := range a.annotations(no) {
+			if n.ObjectMeta.Annotations[k] != v {
+				annotations[k] = v
+			}
+		}
+		if len(annotations) == 0 {
+			continue
+		}
+		logger.Info("Annotate node", "node", n.Name, "annotations", annotations)
+		if err := a.annotate(ctx, n.Name, annotations); err != nil {
+			logger.Error(err, "Annotate node", "node", n.Name)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// allocate Returns allocations for the nodes, and the released
+// numbers. Numbers of existing nodes are kept, and numbers of deleted
+// nodes are released. Released numbers are not reused within
+// releaseGrace. A new node with CIDR annotations from the networks
+// adopts that number if it's free and not annotated on other nodes.
+// Other new nodes get the lowest free number, sorted by name. Numbers
+// in the CIDR annotations of any node are considered in use and are
+// never allocated to another node
+func (a *nodeAllocator) allocate(
+	ctx context.Context, nodes []k8s.Node) (map[string]uint, map[uint]time.Time) {
+	alloc := make(map[string]uint, len(nodes))
+	used := make(map[uint]bool)
+	now := time.Now()
+	released := make(map[uint]time.Time)
+	for no, t := range a.released {
+		if now.Sub(t) < a.releaseGrace {
+			released[no] = t
+			used[no] = true
+		}
+	}
+	inUse := make(map[uint]int) // Number of nodes annotated with a number
+	annotated := make(map[string][]uint)
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.Name)
+		if no, ok := a.allocations[n.Name]; ok {
+			alloc[n.Name] = no
+			used[no] = true
+		}
+		annotated[n.Name] = a.annotatedNumbers(&n)
+		for _, no := range annotated[n.Name] {
+			inUse[no]++
+		}
+	}
+	sort.Strings(names)
+	if a.releaseGrace > 0 {
+		for name, no := range a.allocations {
+			if _, ok := alloc[name]; !ok && !used[no] {
+				released[no] = now
+				used[no] = true
+			}
+		}
+	}
+
+	var unallocated []string
+	for _, name := range names {
+		if _, ok := alloc[name]; ok {
+			continue
+		}
+		for _, no := range annotated[name] {
+			if !used[no] && inUse[no] == 1 && a.valid(no) {
+				alloc[name] = no
+				used[no] = true
+				break
+			}
+		}
+		if _, ok := alloc[name]; !ok {
+			unallocated = append(unallocated, name)
+		}
+	}
+
+	var next uint
+	for i, name := range unallocated {
+		for used[next] || inUse[next] > 0 {
+			next++
+		}
+		if !a.valid(next) {
+			logr.FromContextOrDiscard(ctx).Error(
+				fmt.Errorf("No free CIDRs"), "Allocate",
+				"unallocated", unallocated[i:])
+			break
+		}
+		alloc[name] = next
+		used[next] = true
+	}
+	return alloc, released
+}
+
+// annotatedNumbers Returns the numbers of the CIDRs in the CIDR
+// annotations of a node that are within the "double-dash" CIDRs
+func (a *nodeAllocator) annotatedNumbers(n *k8s.Node) []uint {
+	var numbers []uint
+	found := make(map[uint]bool)
+	for _, nw := range a.networks {
+		value, ok := n.ObjectMeta.Annotations[nw.CidrAnnotation]
+		if !ok {
+			continue
+		}
+		for _, cidr := range strings.Split(value, ",") {
+			for _, dd := range nw.AllocateCidrs {
+				no, err := util.CIDRNumber(dd, strings.TrimSpace(cidr))
+				if err == nil && !found[no] {
+					found[no] = true
+					numbers = append(numbers, no)
+				}
+			}
+		}
+	}
+	return numbers
+}
+
+// valid Returns true if CIDRs can be created from the number for all
+// networks
+func (a *nodeAllocator) valid(no uint) bool {
+	for _, nw := range a.networks {
+		for _, dd := range nw.AllocateCidrs {
+			if _, err := util.CreateCIDR(dd, no); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// annotations Returns the CIDR annotations for a number
+func (a *nodeAllocator) annotations(no uint) map[string]string {
+	annotations := make(map[string]string, len(a.networks))
+	for _, nw := range a.networks {
+		var cidrs []string
+		for _, dd := range nw.AllocateCidrs {
+			// Checked by valid() on allocation
+			cidr, _ := util.CreateCIDR(dd, no)
+			cidrs = append(cidrs, cidr)
+		}
+		annotations[nw.CidrAnnotation] = strings.Join(cidrs, ",")
+	}
+	return annotations
+}
+
+// load Read the allocations from the ConfigMap. The ConfigMap is
+// created if it doesn't exist. Invalid entries are ignored
+func (a *nodeAllocator) load(ctx context.Context) error {
+	logger := logr.FromContextOrDiscard(ctx)
+	toctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	cms := a.client.CoreV1().ConfigMaps(a.namespace)
+	cm, err := cms.Get(toctx, a.name, meta.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		logger.Info("Create allocations", "configmap", a.name)
+		cm, err = cms.Create(toctx, &k8s.ConfigMap{
+			ObjectMeta: meta.ObjectMeta{Name: a.name, Namespace: a.namespace},
+		}, meta.CreateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	allocations := make(map[string]uint, len(cm.Data))
+	released := make(map[uint]time.Time)
+	for node, v := range cm.Data {
+		if strings.HasPrefix(node, releasedPrefix) {
+			no, err := strconv.ParseUint(
+				strings.TrimPrefix(node, releasedPrefix), 10, 32)
+			if err != nil {
+				logger.Error(err, "Invalid released number ignored", "key", node)
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				logger.Error(err, "Invalid released number ignored", "key", node)
+				continue
+			}
+			released[uint(no)] = t
+			continue
+		}
+		no, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			logger.Error(err, "Invalid allocation ignored", "node", node)
+			continue
+		}
+		allocations[node] = uint(no)
+	}
+	a.cm = cm
+	a.allocations = allocations
+	a.released = released
+	logger.Info("Allocations loaded",
+		"nodes", len(allocations), "released", len(released))
+	return nil
+}
+
+// store Write allocations and released numbers to the ConfigMap. The
+// update fails if the ConfigMap has been updated since it was read
+func (a *nodeAllocator) store(
+	ctx context.Context, alloc map[string]uint, released map[uint]time.Time) error {
+	cm := a.cm.DeepCopy()
+	cm.Data = make(map[string]string, len(alloc)+len(released))
+	for node, no := range alloc {
+		cm.Data[node] = strconv.FormatUint(uint64(no), 10)
+	}
+	for no, t := range released {
+		key := releasedPrefix + strconv.FormatUint(uint64(no), 10)
+		cm.Data[key] = t.UTC().Format(time.RFC3339)
+	}
+	toctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	cm, err := a.client.CoreV1().ConfigMaps(a.namespace).Update(
+		toctx, cm, meta.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	a.cm = cm
+	return nil
+}
+
+// annotate Merge-patch annotations of a node
+func (a *nodeAllocator) annotate(
+	ctx context.Context, node string, annotations map[string]string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	toctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	_, err = a.client.CoreV1().Nodes().Patch(
+		toctx, node, types.MergePatchType, data, meta.PatchOptions{})
+	return err
+}
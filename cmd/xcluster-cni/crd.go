@@ -0,0 +1,396 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+// networkGVR The cluster-scoped XclusterNetwork custom resource. The
+// CRD is defined in "xcluster-network-crd.yaml"
+var networkGVR = schema.GroupVersionResource{
+	Group:    "xcluster.nordix.org",
+	Version:  "v1alpha1",
+	Resource: "xclusternetworks",
+}
+
+// xclusterNetwork An XclusterNetwork object. The spec is a
+// networkConfig, and the network name is the object name
+type xclusterNetwork struct {
+	meta.TypeMeta   `json:",inline"`
+	meta.ObjectMeta `json:"metadata,omitempty"`
+	Spec            networkConfig         `json:"spec"`
+	Status          xclusterNetworkStatus `json:"status,omitempty"`
+}
+
+// xclusterNetworkStatus The status has an item per K8s node, written
+// by the daemon on that node. Merge patches are used so daemons
+// doesn't overwrite each others status
+type xclusterNetworkStatus struct {
+	Nodes map[string]xclusterNetworkNodeStatus `json:"nodes,omitempty"`
+}
+
+// xclusterNetworkNodeStatus The status of a network on a K8s node.
+// RoutedNodes is the number of other nodes that routes are set to
+type xclusterNetworkNodeStatus struct {
+	RoutedNodes int        `json:"routedNodes"`
+	Routes      int        `json:"routes"`
+	LastSync    *meta.Time `json:"lastSync,omitempty"`
+	Errors      []string   `json:"errors,omitempty"`
+}
+
+// maxStatusErrors The max number of errors in the status
+const maxStatusErrors = 10
+
+// statusInterval A status that is unchanged, except for the time of
+// the last successful sync, is not written more often than this.
+// Status items of deleted nodes are removed with the same interval
+const statusInterval = time.Minute * 5
+
+// networkWatcher Watches XclusterNetwork objects and applies them as
+// networks. The status of the networks on the own node is written
+// back
+type networkWatcher struct {
+	client     dynamic.NamespaceableResourceInterface
+	nw         *networks
+	node       string
+	store      cache.Store
+	controller cache.Controller
+	mu         sync.Mutex
+	// written The last written status per network, without lastSync
+	written map[string]*statusState
+	// ch Trigs a reconcile. The capacity is just one, so events are
+	// coalesced. Non-blocking sending is used
+	ch chan struct{}
+}
+
+// statusState The last written status of a network
+type statusState struct {
+	status string
+	time   time.Time
+}
+
+// start Start watching XclusterNetwork objects. Returns when the
+// initial objects are read and applied. The watcher should be added
+// as a reporter to the networks before this function is called
+func (w *networkWatcher) start(ctx context.Context, nw *networks) error {
+	logger := logr.FromContextOrDiscard(ctx).WithName("NetworkWatcher")
+	config, err := util.GetRestConfig()
+	if err != nil {
+		return err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	w.client = client.Resource(networkGVR)
+	w.nw = nw
+	w.ch = make(chan struct{}, 1)
+	lw := &cache.ListWatch{
+		ListFunc: func(options meta.ListOptions) (runtime.Object, error) {
+			return w.client.List(ctx, options)
+		},
+		WatchFunc: func(options meta.ListOptions) (watch.Interface, error) {
+			return w.client.Watch(ctx, options)
+		},
+	}
+	funcs := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.trig()
+		},
+		DeleteFunc: func(obj interface{}) {
+			w.trig()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// The generation is not updated on status updates,
+			// which are made by the daemons
+			o, ok1 := oldObj.(*unstructured.Unstructured)
+			n, ok2 := newObj.(*unstructured.Unstructured)
+			if ok1 && ok2 && o.GetGeneration() == n.GetGeneration() {
+				return
+			}
+			w.trig()
+		},
+	}
+	w.store, w.controller = cache.NewInformer(
+		lw, &unstructured.Unstructured{}, time.Hour, funcs)
+	go w.controller.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), w.controller.HasSynced) {
+		return fmt.Errorf("Network watcher interrupted")
+	}
+	logger.Info("Watching", "resource", networkGVR.String())
+	w.reconcile(ctx)
+	go w.run(ctx)
+	go w.pruneStatus(ctx)
+	return nil
+}
+
+// trig Trig a reconcile. Called by the informer event handlers, which
+// must not block since applying networks may take seconds
+func (w *networkWatcher) trig() {
+	select {
+	case w.ch <- struct{}{}:
+	default:
+	}
+}
+
+// run Reconcile when trigged. If some networks failed to start, the
+// reconcile is retried after configPollInterval
+func (w *networkWatcher) run(ctx context.Context) {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-w.ch:
+		case <-retry:
+		case <-ctx.Done():
+			return
+		}
+		retry = nil
+		if err := w.reconcile(ctx); err != nil {
+			retry = time.After(configPollInterval)
+		}
+	}
+}
+
+// pruneStatus Periodically remove status items of nodes that doesn't
+// exist. The daemon on a deleted node can't remove its own item. All
+// daemons do this, but only stale items are patched
+func (w *networkWatcher) pruneStatus(ctx context.Context) {
+	for {
+		w.removeDeletedNodes(ctx)
+		select {
+		case <-time.After(statusInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// removeDeletedNodes Merge-patch away status items of nodes that
+// doesn't exist
+func (w *networkWatcher) removeDeletedNodes(ctx context.Context) {
+	if w.nw.h == nil || !w.nw.h.HasSynced() {
+		return
+	}
+	exists := make(map[string]bool)
+	for _, o := range w.nw.h.List() {
+		if n, ok := o.(*k8s.Node); ok {
+			exists[n.ObjectMeta.Name] = true
+		}
+	}
+	for _, o := range w.store.List() {
+		u, ok := o.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		items, _, _ := unstructured.NestedMap(u.Object, "status", "nodes")
+		deleted := map[string]interface{}{}
+		for node := range items {
+			if !exists[node] {
+				deleted[node] = nil
+			}
+		}
+		if len(deleted) == 0 {
+			continue
+		}
+		logr.FromContextOrDiscard(ctx).Info(
+			"Remove status of deleted nodes", "network", u.GetName(), "nodes", deleted)
+		w.patchStatus(ctx, u.GetName(), deleted)
+	}
+}
+
+// reconcile Apply all valid XclusterNetwork objects. An error is
+// written to the status of invalid objects, and of networks that
+// failed to start. If networks has the same protocol, the first
+// (sorted by name) is used. Returns an error if some network failed
+// to start
+func (w *networkWatcher) reconcile(ctx context.Context) error {
+	logger := logr.FromContextOrDiscard(ctx)
+	objects := w.store.List()
+	xns := make([]xclusterNetwork, 0, len(objects))
+	w.forgetStatus(objects)
+	for _, o := range objects {
+		u, ok := o.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		var xn xclusterNetwork
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(
+			u.Object, &xn)
+		if err != nil {
+			logger.Error(err, "Invalid XclusterNetwork", "name", u.GetName())
+			w.writeStatus(ctx, u.GetName(), nil, err)
+			continue
+		}
+		xns = append(xns, xn)
+	}
+	sort.Slice(xns, func(i, j int) bool {
+		return xns[i].Name < xns[j].Name
+	})
+
+	var cfg daemonConfig
+	var nv networkValidator
+	for _, xn := range xns {
+		n := xn.Spec
+		n.Name = xn.Name
+		if err := nv.check(&n); err != nil {
+			logger.Error(err, "Invalid XclusterNetwork", "name", xn.Name)
+			w.writeStatus(ctx, xn.Name, nil, err)
+			continue
+		}
+		cfg.Networks = append(cfg.Networks, n)
+	}
+	err := w.nw.apply(ctx, &cfg)
+	if err != nil {
+		logger.Error(err, "Apply XclusterNetworks, retried")
+	}
+	w.nw.mu.Lock()
+	failed := make(map[string]error, len(w.nw.failed))
+	for name, ferr := range w.nw.failed {
+		failed[name] = ferr
+	}
+	w.nw.mu.Unlock()
+	for name, ferr := range failed {
+		w.writeStatus(ctx, name, nil, ferr)
+	}
+	return err
+}
+
+// report A syncReporter that writes the status of the network
+func (w *networkWatcher) report(
+	ctx context.Context, network string, result *syncResult, err error) {
+	w.writeStatus(ctx, network, result, err)
+}
+
+// writeStatus Merge-patch the status for the own node. Errors from
+// the sync, or an invalid object, are included. LastSync is only
+// updated on a successful sync. The status is only written if it's
+// changed, or if it's older than statusInterval, so lastSync may lag
+func (w *networkWatcher) writeStatus(
+	ctx context.Context, network string, result *syncResult, err error) {
+	if w.node == "" || w.client == nil {
+		return
+	}
+	status := map[string]interface{}{}
+	var errors []string
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+	if result != nil {
+		status["routedNodes"] = result.Nodes
+		status["routes"] = result.Routes
+		for _, f := range result.Failures {
+			if len(errors) >= maxStatusErrors {
+				break
+			}
+			errors = append(errors, failureString(&f))
+		}
+		for _, c := range result.Conflicts {
+			if len(errors) >= maxStatusErrors {
+				break
+			}
+			errors = append(errors, fmt.Sprintf(
+				"CIDR %s of %s conflicts with %s of %s",
+				c.Cidr, c.Node, c.OtherCidr, c.Other))
+		}
+	}
+	if len(errors) > 0 {
+		status["errors"] = errors
+	} else {
+		status["errors"] = nil // Removes old errors
+	}
+	data, jerr := json.Marshal(status)
+	if jerr != nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.written == nil {
+		w.written = make(map[string]*statusState)
+	}
+	now := time.Now()
+	if st, ok := w.written[network]; ok && st.status == string(data) &&
+		now.Sub(st.time) < statusInterval {
+		return
+	}
+	if result != nil && err == nil {
+		status["lastSync"] = meta.NewTime(now)
+	}
+	if w.patchStatus(ctx, network, map[string]interface{}{w.node: status}) {
+		w.written[network] = &statusState{status: string(data), time: now}
+	}
+}
+
+// forgetStatus Forget the written status of networks that doesn't
+// exist, so the status is written if they are re-created
+func (w *networkWatcher) forgetStatus(objects []interface{}) {
+	exists := make(map[string]bool)
+	for _, o := range objects {
+		if u, ok := o.(*unstructured.Unstructured); ok {
+			exists[u.GetName()] = true
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for network := range w.written {
+		if !exists[network] {
+			delete(w.written, network)
+		}
+	}
+}
+
+// patchStatus Merge-patch status items of a network. A nil item is
+// removed. Returns true if the patch succeeded
+func (w *networkWatcher) patchStatus(
+	ctx context.Context, network string, items map[string]interface{}) bool {
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"nodes": items,
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return false
+	}
+	toctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	_, err = w.client.Patch(
+		toctx, network, types.MergePatchType, data, meta.PatchOptions{}, "status")
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "Write status", "network", network)
+		return false
+	}
+	return true
+}
+
+// failureString Returns a short description of a failed operation
+func failureString(f *syncFailure) string {
+	switch {
+	case f.Route != nil:
+		return fmt.Sprintf("%s %s: %s", f.Op, f.Route.Dst, f.Error)
+	case f.Rule != nil:
+		return fmt.Sprintf("%s %s%s: %s", f.Op, f.Rule.Src, f.Rule.Dst, f.Error)
+	}
+	return fmt.Sprintf("%s: %s", f.Op, f.Error)
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"flag"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/Nordix/xcluster-cni/pkg/util"
@@ -17,38 +19,54 @@ import (
 	addresses and POD network CIDRs. Addresses and CIDR can be read
 	from annotations or the K8s fields. The routing daemon configures
 	routes for POD network CIDRs to node addresses for IPv4 and IPv6.
+	Several networks can be defined in a config file.
 */
 func cmdDaemon(ctx context.Context, args []string) int {
 	logger := logr.FromContextOrDiscard(ctx)
 	logger.Info("Xcluster-cni daemon started", "pid", os.Getpid())
 	klog.SetLogger(logger) // Use our logger for K8s logging
 
-	// Create a syncer
-	protocol := os.Getenv("PROTOCOL")
-	if protocol == "" {
-		protocol = "202"
+	flagset := flag.NewFlagSet("daemon", flag.ExitOnError)
+	dryRun := flagset.String("dryrun", os.Getenv("DRY_RUN"),
+		"Only log|json planned route changes, nothing is changed")
+	configFile := flagset.String("config", os.Getenv("CONFIG_FILE"),
+		"Config file with networks")
+	crd := flagset.Bool("crd", os.Getenv("NETWORK_CRD") == "true",
+		"Networks are defined by XclusterNetwork objects")
+	admin := flagset.String("admin", os.Getenv("ADMIN_ADDRESS"),
+		"Address for the admin HTTP server, e.g. :9402. Empty means no server")
+	if err := flagset.Parse(args[1:]); err != nil {
+		logger.Error(err, "Parse options")
+		return 1
 	}
-	rh, err := util.NewRouteHandler(ctx, protocol)
-	if err != nil {
-		logger.Error(err, "NewRouteHandler")
+	if *dryRun != "" && *dryRun != "log" && *dryRun != "json" {
+		logger.Info("Invalid dry-run", "value", *dryRun)
 		return 1
 	}
-	sh := syncHandler{
-		protocol:          protocol,
-		cidrAnnotation:    os.Getenv("CIDR_ANNOTATION"),
-		addressAnnotation: os.Getenv("ADDRESS_ANNOTATION"),
-		rh:                rh,
+
+	// The networks are defined in a config file, by environment
+	// variables, or by XclusterNetwork objects
+	if *crd && *configFile != "" {
+		logger.Info("A config file can't be used with XclusterNetwork objects")
+		return 1
 	}
-	syncer := syncer{
-		sh: &sh,
-		// The capacity is just one to make sure the channel is
-		// drained on each sync. Non-blocking sending is used
-		ch:       make(chan struct{}, 1),
-		lastSync: time.Now(),
+	var cfg *daemonConfig
+	var err error
+	if *configFile != "" {
+		cfg, err = readConfig(*configFile)
+	} else if !*crd {
+		cfg, err = envConfig()
+	}
+	if err != nil {
+		logger.Error(err, "Config", "file", *configFile)
+		return 1
 	}
-	go syncer.run(ctx) // Start the syncing go function
 
-	// Start watching Nodes
+	// Start watching Nodes. All networks are trigged on any update
+	nw := networks{
+		dryRun: *dryRun,
+		items:  make(map[string]*network),
+	}
 	clientset, err := util.GetClientset()
 	if err != nil {
 		logger.Error(err, "GetClientset")
@@ -56,13 +74,16 @@ func cmdDaemon(ctx context.Context, args []string) int {
 	}
 	funcs := cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			syncer.trig(ctx)
+			informerLastEvent.SetToCurrentTime()
+			nw.trig()
 		},
 		DeleteFunc: func(obj interface{}) {
-			syncer.trig(ctx)
+			informerLastEvent.SetToCurrentTime()
+			nw.trig()
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
-			syncer.trig(ctx)
+			informerLastEvent.SetToCurrentTime()
+			nw.trig()
 		},
 	}
 	h, err := util.CreateNodeHandler(ctx, clientset, &funcs)
@@ -70,14 +91,89 @@ func cmdDaemon(ctx context.Context, args []string) int {
 		logger.Error(err, "CreateNodeHandler")
 		return 1
 	}
-	// (no risk for race here since sync is delayed with minSyncInterval)
-	syncer.h = h
+	nw.h = h
+	nw.clientset = clientset
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		// Problems with the own node are recorded as K8s Events
+		nw.reporters = append(nw.reporters, newNodeEvents(ctx, clientset, node).report)
+		if *dryRun == "" {
+			// The health of the route sync is a condition of the node
+			c := nodeCondition{client: clientset, node: node}
+			nw.reporters = append(nw.reporters, c.report)
+			nw.removers = append(nw.removers, c.remove)
+		}
+	}
+
+	if *admin != "" {
+		a := adminServer{nw: &nw}
+		if err := a.start(ctx, *admin); err != nil {
+			logger.Error(err, "Start admin server", "address", *admin)
+			return 1
+		}
+	}
+
+	// Start a syncer for each network
+	if *crd {
+		w := networkWatcher{node: os.Getenv("NODE_NAME")}
+		nw.reporters = append(nw.reporters, w.report)
+		if err := w.start(ctx, &nw); err != nil {
+			logger.Error(err, "Watch XclusterNetworks")
+			return 1
+		}
+	} else if err := nw.apply(ctx, cfg); err != nil {
+		logger.Error(err, "Start networks")
+		return 1
+	}
+	if *configFile != "" {
+		go nw.watchConfig(ctx, *configFile)
+	}
 
 	<-ctx.Done()
 	logger.Error(ctx.Err(), "Xcluster-cni daemon terminating")
+
+	// Wait for ongoing syncs and remove the policy routing rules.
+	nw.shutdown()
 	return 0
 }
 
+// defaultRulePriority The priority of policy routing rules if
+// RULE_PRIORITY is not set. Must be lower than the rule for the main
+// table (32766)
+const defaultRulePriority = 1000
+
+// Handler constructors. May be replaced in unit-test
+var (
+	newRouteHandler = util.NewRouteHandler
+	newRuleHandler  = util.NewRuleHandler
+)
+
+// newHandlers Create a route handler for the table, and a rule handler
+// if a table is used without a VRF. Policy routing rules are not
+// needed for a VRF, since interfaces enslaved to the VRF use its table
+func newHandlers(
+	ctx context.Context, backend, protocol string, table int, vrf string,
+	priority int) (util.RouteHandler, util.RuleHandler, error) {
+	rh, err := newRouteHandler(ctx, backend, protocol, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	if table == 0 || vrf != "" {
+		return rh, nil, nil
+	}
+	if priority == 0 {
+		priority = defaultRulePriority
+	}
+	ruh, err := newRuleHandler(ctx, backend, protocol, table, priority)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rh, ruh, nil
+}
+
+// defaultDeleteGuardOverride If this file is created, e.g. with
+// "kubectl exec", a refused mass deletion of routes is allowed
+const defaultDeleteGuardOverride = "/tmp/xcluster-cni-allow-delete"
+
 // syncer The syncer has a trig() function that is called when any K8s
 // node update occurs. When trig() is called a signal is sent to a go
 // routine that reads all node objects and sets up or update routes.
@@ -85,11 +181,40 @@ func cmdDaemon(ctx context.Context, args []string) int {
 type syncer struct {
 	h        util.Handler
 	ch       chan struct{}
+	done     chan struct{}
 	sh       *syncHandler
 	lastSync time.Time
+	// retryDelay The delay before the next retry of a failed sync,
+	// 0 (zero) after a successful sync
+	retryDelay time.Duration
+	retry      *time.Timer
+	// dryRun Planned route changes are logged ("log") or printed
+	// to stdout ("json")
+	dryRun string
+	// network The name of the network
+	network string
+	// reporters Are called after each sync
+	reporters []syncReporter
+	// publisher If set, local addresses are published on each sync
+	publisher *addressPublisher
+	// mu Protects the state below, which is read by the admin server
+	mu sync.Mutex
+	// busy The start time of an ongoing sync, zero when idle
+	busy time.Time
+	// last The result of the last sync, nil if it failed
+	last     *syncResult
+	lastTime time.Time
+	// synced Set when a sync has succeeded
+	synced bool
 }
 
+// syncReporter Called after each sync with the result, or an error if
+// the sync couldn't be performed
+type syncReporter func(
+	ctx context.Context, network string, result *syncResult, err error)
+
 const minSyncInterval = time.Second * 5
+const maxRetryDelay = time.Minute * 5
 
 // trig Trigs a route sync. Called on any K8s node object update
 func (s *syncer) trig(ctx context.Context) {
@@ -100,13 +225,17 @@ func (s *syncer) trig(ctx context.Context) {
 	select {
 	case s.ch <- struct{}{}:
 		logger.Info("Sync trigged")
+		syncTrigs.WithLabelValues(s.network, "triggered").Inc()
 	default:
 		logger.Info("Sync already trigged")
+		syncTrigs.WithLabelValues(s.network, "coalesced").Inc()
 	}
 }
 
-// run A go routine to run the sync
+// run A go routine to run the sync. The "done" channel is closed on
+// return
 func (s *syncer) run(ctx context.Context) {
+	defer close(s.done)
 	for {
 		select {
 		case <-s.ch:
@@ -145,16 +274,91 @@ func (s *syncer) sync(ctx context.Context) {
 
 	start := time.Now()
 	logger.Info("Syncing routes start")
+	s.mu.Lock()
+	s.busy = start
+	s.mu.Unlock()
 	nodeList := s.h.List()
 	nodes := make([]k8s.Node, len(nodeList))
 	for i := range nodeList {
 		np := nodeList[i].(*k8s.Node)
 		nodes[i] = *np
 	}
-	err := s.sh.syncRoutes(ctx, nodes)
+	var pubErr error
+	if s.publisher != nil {
+		if pubErr = s.publisher.publish(ctx, nodes); pubErr != nil {
+			logger.Error(pubErr, "Publish addresses")
+		}
+	}
+	result, err := s.sh.syncRoutes(ctx, nodes)
+	s.lastSync = time.Now()
+	s.mu.Lock()
+	s.busy = time.Time{}
+	s.last = result
+	s.lastTime = s.lastSync
+	if err == nil {
+		s.synced = true
+	}
+	s.mu.Unlock()
+	recordSync(s.network, s.sh.protocol, s.lastSync.Sub(start), result, err)
 	if err != nil {
 		logger.Error(err, "Sync routes")
+	} else {
+		logger.Info("Syncing routes finish", "duration", s.lastSync.Sub(start),
+			"routes", result.Routes, "added", result.Added,
+			"replaced", result.Replaced, "deleted", result.Deleted,
+			"refused", result.Refused, "failures", len(result.Failures),
+			"conflicts", len(result.Conflicts))
 	}
-	s.lastSync = time.Now()
-	logger.Info("Syncing routes finish", "duration", s.lastSync.Sub(start))
+	if err == nil && s.dryRun != "" {
+		s.emitPlan(ctx, result)
+	}
+	for _, report := range s.reporters {
+		report(ctx, s.network, result, err)
+	}
+	if err != nil || len(result.Failures) > 0 || result.Refused > 0 || pubErr != nil {
+		s.scheduleRetry(ctx)
+	} else {
+		s.retryDelay = 0
+	}
+}
+
+// scheduleRetry Trig a new sync after a delay. The delay is doubled
+// on each consecutive failed sync, up to 'maxRetryDelay'. Failed
+// syncs are retried without waiting for a node update or the
+// informer re-sync
+func (s *syncer) scheduleRetry(ctx context.Context) {
+	if s.retryDelay == 0 {
+		s.retryDelay = minSyncInterval
+	} else if s.retryDelay *= 2; s.retryDelay > maxRetryDelay {
+		s.retryDelay = maxRetryDelay
+	}
+	logr.FromContextOrDiscard(ctx).Info("Retry sync", "delay", s.retryDelay)
+	if s.retry != nil {
+		s.retry.Stop()
+	}
+	s.retry = time.AfterFunc(s.retryDelay, func() {
+		s.trig(ctx)
+	})
+}
+
+// emitPlan Log, or print as json, the planned route changes in
+// dry-run mode
+func (s *syncer) emitPlan(ctx context.Context, result *syncResult) {
+	plan := result.Plan
+	if s.dryRun == "json" {
+		util.EmitJson(struct {
+			Time    time.Time `json:"time"`
+			Network string    `json:"network"`
+			Routes  int       `json:"routes"`
+			*routePlan
+		}{s.lastSync, s.network, result.Routes, plan})
+		return
+	}
+	logger := logr.FromContextOrDiscard(ctx)
+	if plan.empty() {
+		logger.Info("Dry-run, no route changes", "routes", result.Routes)
+		return
+	}
+	logger.Info("Dry-run, planned route changes", "routes", result.Routes,
+		"add", plan.Add, "replace", plan.Replace, "delete", plan.Delete)
 }
@@ -0,0 +1,516 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+)
+
+// cmdDoctor Run checks on the local node, and print pass or fail with
+// a hint for each check. Exits with 1 if any check fails.
+func cmdDoctor(ctx context.Context, args []string) int {
+	flagset := flag.NewFlagSet("doctor", flag.ExitOnError)
+	flagset.Usage = func() {
+		fmt.Fprintf(flagset.Output(), `Syntax: doctor [options]
+
+  Diagnose the local node. Checks the CNI config and its MTU, the
+  CNI plugin binaries, forwarding and rp_filter sysctls, that routes
+  are as a sync would want, and that all gateways are on a local
+  subnet. Must run on the node, or in a POD with hostNetwork and the
+  CNI directories mounted. The CNI directories default to the mounts
+  in the xcluster-cni POD if they exist, else to the node
+  directories. Exits with 1 if any check fails.
+
+`)
+		flagset.PrintDefaults()
+	}
+	cniDir := flagset.String("cni-dir", cniPath("/cni/net.d", "/etc/cni/net.d"),
+		"CNI config directory")
+	cniBin := flagset.String("cni-bin", cniPath("/cni/bin", "/opt/cni/bin"),
+		"CNI plugin directory")
+	plugins := flagset.String("plugins", "",
+		"Comma separated plugins required in addition to the ones in the CNI config")
+	nodesFile := flagset.String("nodes", "", "File with Node objects. Default is to read from K8s")
+	myself := flagset.String("node", os.Getenv("NODE_NAME"), "The own node name")
+	output := flagset.String("o", "table", "Output format; table|json")
+	nf := addNetworkFlags(flagset)
+	if err := flagset.Parse(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid output format %s\n", *output)
+		return 1
+	}
+	if *myself == "" {
+		fmt.Fprintln(os.Stderr, "The own node name must be specified")
+		return 1
+	}
+	networks, err := nf.networks()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	nodes, err := loadNodes(ctx, *nodesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	node := util.FindNode(ctx, nodes, *myself)
+	if node == nil {
+		fmt.Fprintf(os.Stderr, "Own node %s not found\n", *myself)
+		return 1
+	}
+
+	d := doctor{
+		cniDir:        *cniDir,
+		cniBin:        *cniBin,
+		procSys:       "/proc/sys",
+		node:          node,
+		nodes:         nodes,
+		networks:      networks,
+		mtuAnnotation: os.Getenv("ADDRESS_ANNOTATION"),
+	}
+	if *plugins != "" {
+		d.plugins = strings.Split(*plugins, ",")
+	}
+	ctx = logr.NewContext(ctx, logr.Discard()) // Problems are printed
+	checks := d.run(ctx)
+	if *output == "json" {
+		util.EmitJson(checks)
+	} else {
+		printChecks(os.Stdout, checks)
+	}
+	for _, c := range checks {
+		if !c.Pass {
+			return 1
+		}
+	}
+	return 0
+}
+
+// cniPath Returns the path in the xcluster-cni POD if it exists, else
+// the path on the node
+func cniPath(pod, node string) string {
+	if _, err := os.Stat(pod); err == nil {
+		return pod
+	}
+	return node
+}
+
+// doctorCheck The result of a check. A hint is given on failures
+type doctorCheck struct {
+	Name    string `json:"name"`
+	Network string `json:"network,omitempty"`
+	Pass    bool   `json:"pass"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// doctor Checks of the local node. The procSys is normally
+// "/proc/sys", and the nodes must include the own node
+type doctor struct {
+	cniDir        string
+	cniBin        string
+	procSys       string
+	plugins       []string
+	node          *k8s.Node
+	nodes         []k8s.Node
+	networks      []networkConfig
+	mtuAnnotation string
+	// syncHandler may be set in unit-test. Default is a dry-run
+	// handler from newSyncHandler
+	syncHandler func(ctx context.Context, n *networkConfig) (*syncHandler, error)
+	// localInterface may be set in unit-test. Default is
+	// util.GetInterface
+	localInterface func(ip string) (*net.Interface, error)
+	checks         []doctorCheck
+}
+
+// doctorNetwork The wanted routes of a network on the local node
+type doctorNetwork struct {
+	name string
+	sh   *syncHandler
+	want map[string]util.Route
+	err  error
+}
+
+// cniConfig The parts of a CNI config, or config list, that are
+// checked
+type cniConfig struct {
+	cniPlugin
+	Name    string      `json:"name"`
+	Plugins []cniPlugin `json:"plugins,omitempty"`
+}
+
+// cniPlugin A plugin in a CNI config
+type cniPlugin struct {
+	Type string `json:"type"`
+	MTU  int    `json:"mtu,omitempty"`
+	Ipam *struct {
+		Type string `json:"type"`
+	} `json:"ipam,omitempty"`
+}
+
+// run Run all checks and return the results
+func (d *doctor) run(ctx context.Context) []doctorCheck {
+	if d.syncHandler == nil {
+		d.syncHandler = func(
+			ctx context.Context, n *networkConfig) (*syncHandler, error) {
+			return newSyncHandler(ctx, n, true)
+		}
+	}
+	if d.localInterface == nil {
+		d.localInterface = util.GetInterface
+	}
+	d.checks = nil
+	conf := d.checkCniConfig()
+	d.checkPlugins(conf)
+	nets := d.wantedRoutes(ctx)
+	d.checkSysctls(nets)
+	for _, dn := range nets {
+		d.checkRoutes(ctx, dn)
+		d.checkGateways(dn)
+	}
+	return d.checks
+}
+
+// pass Record a passed check
+func (d *doctor) pass(name, network, message string) {
+	d.checks = append(d.checks, doctorCheck{
+		Name: name, Network: network, Pass: true, Message: message})
+}
+
+// fail Record a failed check
+func (d *doctor) fail(name, network, message, hint string) {
+	d.checks = append(d.checks, doctorCheck{
+		Name: name, Network: network, Message: message, Hint: hint})
+}
+
+// checkCniConfig Check that a CNI config exists, and that its MTU
+// matches the MTU of the interface with the node address (as computed
+// by "k8smtu"). The container runtime uses the first config in
+// lexical order, so that is the one checked
+func (d *doctor) checkCniConfig() *cniConfig {
+	var files []string
+	for _, pattern := range []string{"*.conf", "*.conflist", "*.json"} {
+		m, _ := filepath.Glob(filepath.Join(d.cniDir, pattern))
+		files = append(files, m...)
+	}
+	if len(files) == 0 {
+		d.fail("cni-config", "", fmt.Sprintf("No CNI config in %s", d.cniDir),
+			"The xcluster-cni init container installs the config, unless INSTALL_K8S_NET is \"no\". Check its log")
+		return nil
+	}
+	sort.Strings(files)
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		d.fail("cni-config", "", err.Error(), "Check the file permissions")
+		return nil
+	}
+	var conf cniConfig
+	if err := json.Unmarshal(data, &conf); err != nil {
+		d.fail("cni-config", "", fmt.Sprintf("Parse failed, %s: %v", files[0], err),
+			"Correct the config, or remove it and restart the xcluster-cni POD to re-install it")
+		return nil
+	}
+	d.pass("cni-config", "", fmt.Sprintf("%s, name %s", files[0], conf.Name))
+
+	mtu := 0
+	for _, p := range conf.plugins() {
+		if p.MTU != 0 {
+			mtu = p.MTU
+			break
+		}
+	}
+	if mtu == 0 {
+		d.pass("cni-mtu", "", "No MTU in the config, the plugin default is used")
+		return &conf
+	}
+	adr, err := mtuAddress(d.node, d.mtuAnnotation)
+	if err != nil {
+		d.fail("cni-mtu", "", err.Error(), "Check the node addresses, and ADDRESS_ANNOTATION")
+		return &conf
+	}
+	iface, err := d.localInterface(adr)
+	if err != nil {
+		d.fail("cni-mtu", "", err.Error(),
+			fmt.Sprintf("The node address %s must be on a local interface", adr))
+		return &conf
+	}
+	if iface.MTU != mtu {
+		d.fail("cni-mtu", "", fmt.Sprintf("MTU %d in the config, %s has MTU %d",
+			mtu, iface.Name, iface.MTU),
+			fmt.Sprintf("Set \"mtu\" to %d in the config. Only new PODs get the new MTU", iface.MTU))
+		return &conf
+	}
+	d.pass("cni-mtu", "", fmt.Sprintf("MTU %d, same as %s", mtu, iface.Name))
+	return &conf
+}
+
+// plugins Returns the plugins of a config, or config list
+func (c *cniConfig) plugins() []cniPlugin {
+	if len(c.Plugins) > 0 {
+		return c.Plugins
+	}
+	return []cniPlugin{c.cniPlugin}
+}
+
+// checkPlugins Check that the plugins in the CNI config, including
+// IPAM plugins, and additional required plugins are executable
+func (d *doctor) checkPlugins(conf *cniConfig) {
+	var required []string
+	if conf != nil {
+		for _, p := range conf.plugins() {
+			required = append(required, p.Type)
+			if p.Ipam != nil && p.Ipam.Type != "" {
+				required = append(required, p.Ipam.Type)
+			}
+		}
+	}
+	required = append(required, d.plugins...)
+	var found, missing []string
+	checked := make(map[string]bool)
+	for _, p := range required {
+		p = strings.TrimSpace(p)
+		if p == "" || checked[p] {
+			continue
+		}
+		checked[p] = true
+		if fi, err := os.Stat(filepath.Join(d.cniBin, p)); err != nil ||
+			fi.IsDir() || fi.Mode()&0111 == 0 {
+			missing = append(missing, p)
+		} else {
+			found = append(found, p)
+		}
+	}
+	if len(missing) > 0 {
+		d.fail("plugins", "", fmt.Sprintf("Missing in %s: %s",
+			d.cniBin, strings.Join(missing, ",")),
+			"The xcluster-cni init container installs bridge, host-local and kube-node. Check its log")
+		return
+	}
+	if len(found) == 0 {
+		d.pass("plugins", "", "No plugins required")
+		return
+	}
+	d.pass("plugins", "", fmt.Sprintf("Found in %s: %s",
+		d.cniBin, strings.Join(found, ",")))
+}
+
+// wantedRoutes Returns the routes a sync would want for each network
+func (d *doctor) wantedRoutes(ctx context.Context) []doctorNetwork {
+	nets := make([]doctorNetwork, len(d.networks))
+	for i := range d.networks {
+		n := &d.networks[i]
+		nets[i].name = n.Name
+		if nets[i].sh, nets[i].err = d.syncHandler(ctx, n); nets[i].err != nil {
+			continue
+		}
+		myself := d.node.ObjectMeta.Name
+		selected := nets[i].sh.selectNodes(ctx, d.nodes, myself)
+		var result syncResult
+		nets[i].want = nets[i].sh.computeRoutes(ctx, selected, myself, &result)
+	}
+	return nets
+}
+
+// checkSysctls Check that forwarding is enabled for the families of
+// the wanted routes, and that strict reverse path filtering isn't used
+// on the interfaces of the gateways. Strict filtering drops packets
+// from other nodes if the return path is asymmetric, e.g. with
+// multiple networks or multipath routes
+func (d *doctor) checkSysctls(nets []doctorNetwork) {
+	families := make(map[int]bool)
+	ifaces := make(map[string]bool)
+	for _, dn := range nets {
+		for _, r := range dn.want {
+			if r.Type != "" {
+				continue
+			}
+			_, family := canonicalCidr(r.Dst)
+			families[family] = true
+			for _, nh := range r.NexthopList() {
+				if iface, err := d.localInterface(nh.Gateway); err == nil {
+					ifaces[iface.Name] = true
+				}
+			}
+		}
+	}
+
+	forwarding := []string{"net/ipv4/ip_forward"}
+	if families[6] {
+		forwarding = append(forwarding, "net/ipv6/conf/all/forwarding")
+	}
+	for _, name := range forwarding {
+		v, err := d.sysctl(name)
+		switch {
+		case err != nil:
+			d.fail("forwarding", "", err.Error(), "Run on the node, or in a POD with hostNetwork")
+		case v != 1:
+			d.fail("forwarding", "", fmt.Sprintf("%s is %d", sysctlName(name), v),
+				fmt.Sprintf("sysctl -w %s=1", sysctlName(name)))
+		default:
+			d.pass("forwarding", "", fmt.Sprintf("%s is 1", sysctlName(name)))
+		}
+	}
+
+	all, err := d.sysctl("net/ipv4/conf/all/rp_filter")
+	if err != nil {
+		d.fail("rp-filter", "", err.Error(), "Run on the node, or in a POD with hostNetwork")
+		return
+	}
+	names := []string{"all"}
+	for name := range ifaces {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	var strict []string
+	for _, name := range names {
+		// The effective value is the max of "all" and the interface
+		v := all
+		if name != "all" {
+			if i, err := d.sysctl("net/ipv4/conf/" + name + "/rp_filter"); err == nil && i > v {
+				v = i
+			}
+		}
+		if v == 1 {
+			strict = append(strict, name)
+		}
+	}
+	if len(strict) > 0 {
+		var hints []string
+		for _, name := range strict {
+			hints = append(hints, fmt.Sprintf("sysctl -w net.ipv4.conf.%s.rp_filter=2", name))
+		}
+		d.fail("rp-filter", "", fmt.Sprintf("Strict rp_filter on %s",
+			strings.Join(strict, ",")),
+			"Use loose (2) or no (0) filtering; "+strings.Join(hints, "; "))
+		return
+	}
+	d.pass("rp-filter", "", fmt.Sprintf("Not strict on %s", strings.Join(names, ",")))
+}
+
+// sysctl Returns the integer value of a sysctl, e.g. "net/ipv4/ip_forward"
+func (d *doctor) sysctl(name string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(d.procSys, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// sysctlName Returns the sysctl name in dotted form
+func sysctlName(name string) string {
+	return strings.ReplaceAll(name, "/", ".")
+}
+
+// checkRoutes Check that the routes with the protocol of the network
+// are the ones a sync would want
+func (d *doctor) checkRoutes(ctx context.Context, dn doctorNetwork) {
+	if dn.err != nil {
+		d.fail("routes", dn.name, dn.err.Error(), "Check the network config")
+		return
+	}
+	present, err := dn.sh.rh.GetRoutes(ctx)
+	if err != nil {
+		d.fail("routes", dn.name, err.Error(),
+			"Run on the node, or in a POD with hostNetwork")
+		return
+	}
+	plan := dn.sh.planRoutes(dn.want, present)
+	if plan.empty() {
+		d.pass("routes", dn.name, fmt.Sprintf("%d routes with protocol %s as wanted",
+			len(dn.want), dn.sh.protocol))
+		return
+	}
+	var diffs []string
+	for _, r := range plan.Add {
+		diffs = append(diffs, "missing "+r.Dst)
+	}
+	for _, r := range plan.Replace {
+		diffs = append(diffs, "differs "+r.To.Dst)
+	}
+	for _, r := range plan.Delete {
+		diffs = append(diffs, "superfluous "+r.Dst)
+	}
+	d.fail("routes", dn.name, strings.Join(diffs, ", "),
+		"Check the daemon log, and /debug/state on the admin server. A sync may have failed, or the delete guard refused deletions")
+}
+
+// checkGateways Check that the gateways of all wanted routes are on a
+// local subnet
+func (d *doctor) checkGateways(dn doctorNetwork) {
+	if dn.err != nil {
+		return
+	}
+	var unreachable []string
+	found := make(map[string]bool)
+	ifaces := make(map[string]bool)
+	for _, r := range sortedRoutes(dn.want) {
+		for _, nh := range r.NexthopList() {
+			if found[nh.Gateway] {
+				continue
+			}
+			found[nh.Gateway] = true
+			iface, err := d.localInterface(nh.Gateway)
+			if err != nil {
+				unreachable = append(unreachable,
+					fmt.Sprintf("%s (node %s)", nh.Gateway, r.Node))
+				continue
+			}
+			ifaces[iface.Name] = true
+		}
+	}
+	if len(unreachable) > 0 {
+		d.fail("gateways", dn.name, "Not on a local subnet: "+strings.Join(unreachable, ", "),
+			"The node addresses must be on the subnet of a local interface. Check the address annotation, and the addresses of the interfaces")
+		return
+	}
+	if len(found) == 0 {
+		d.pass("gateways", dn.name, "No gateways")
+		return
+	}
+	names := make([]string, 0, len(ifaces))
+	for name := range ifaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	d.pass("gateways", dn.name, fmt.Sprintf("%d gateways on local subnets of %s",
+		len(found), strings.Join(names, ",")))
+}
+
+// printChecks Print the checks with hints on failures
+func printChecks(out io.Writer, checks []doctorCheck) {
+	for _, c := range checks {
+		result := "PASS"
+		if !c.Pass {
+			result = "FAIL"
+		}
+		name := c.Name
+		if c.Network != "" {
+			name += "/" + c.Network
+		}
+		fmt.Fprintf(out, "%s  %-18s %s\n", result, name, c.Message)
+		if c.Hint != "" {
+			fmt.Fprintf(out, "      Hint: %s\n", c.Hint)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcore "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventInterval The same event is not emitted more often than this
+const eventInterval = time.Minute * 10
+
+// nodeEvents Records node problems as K8s Events on the own Node
+// object, so they are shown by "kubectl describe node". Each daemon
+// only records problems with its own node. An event is emitted when a
+// problem appears, and is repeated every "eventInterval" while it
+// remains. The K8s event correlator aggregates and rate-limits events
+// as a last resort
+type nodeEvents struct {
+	recorder record.EventRecorder
+	node     string
+	mu       sync.Mutex
+	// emitted When an event was last emitted, per network
+	emitted map[string]map[nodeProblem]time.Time
+}
+
+// newNodeEvents Create a nodeEvents that emit events until the
+// context is cancelled
+func newNodeEvents(
+	ctx context.Context, clientset kubernetes.Interface, node string) *nodeEvents {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(
+		record.CorrelatorOptions{
+			BurstSize: 10,
+			QPS:       1.0 / 60,
+		})
+	broadcaster.StartRecordingToSink(&typedcore.EventSinkImpl{
+		Interface: clientset.CoreV1().Events(""),
+	})
+	go func() {
+		<-ctx.Done()
+		broadcaster.Shutdown()
+	}()
+	return &nodeEvents{
+		recorder: broadcaster.NewRecorder(
+			scheme.Scheme, k8s.EventSource{Component: "xcluster-cni", Host: node}),
+		node: node,
+	}
+}
+
+// report A syncReporter that emits events for new problems with the
+// own node. Problems that are gone are forgotten, so they are emitted
+// again if they re-appear
+func (e *nodeEvents) report(
+	ctx context.Context, network string, result *syncResult, err error) {
+	if result == nil {
+		return // The sync failed, no problems are known
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.emitted == nil {
+		e.emitted = make(map[string]map[nodeProblem]time.Time)
+	}
+	last := e.emitted[network]
+	current := make(map[nodeProblem]time.Time)
+	now := time.Now()
+	for _, p := range e.problems(result) {
+		if t, ok := last[p]; ok && now.Sub(t) < eventInterval {
+			current[p] = t
+			continue
+		}
+		logr.FromContextOrDiscard(ctx).V(1).Info(
+			"Emit event", "reason", p.Reason, "message", p.Message)
+		e.recorder.Event(e.ref(), k8s.EventTypeWarning, p.Reason,
+			fmt.Sprintf("Network %s: %s", network, p.Message))
+		current[p] = now
+	}
+	e.emitted[network] = current
+}
+
+// problems Returns the problems with the own node. A conflicting CIDR
+// of another node is also a problem for the own node, since the other
+// node's daemon will consider the own CIDR as the conflicting one
+func (e *nodeEvents) problems(result *syncResult) []nodeProblem {
+	var problems []nodeProblem
+	for _, p := range result.Problems {
+		if p.Node == e.node {
+			problems = append(problems, p)
+		}
+	}
+	for _, c := range result.Conflicts {
+		if c.Other == e.node {
+			problems = append(problems, nodeProblem{
+				Node:   e.node,
+				Reason: reasonCidrConflict,
+				Message: fmt.Sprintf("CIDR %s conflicts with %s of node %s",
+					c.OtherCidr, c.Cidr, c.Node),
+			})
+		}
+	}
+	return problems
+}
+
+// ref Returns a reference to the own node. The UID is the node name,
+// as used by the kubelet, since "kubectl describe node" searches for
+// events with that UID
+func (e *nodeEvents) ref() *k8s.ObjectReference {
+	return &k8s.ObjectReference{
+		Kind: "Node",
+		Name: e.node,
+		UID:  types.UID(e.node),
+	}
+}
@@ -40,6 +40,12 @@ func main() {
 	cmd.Register("mtu", cmdMTU)
 	cmd.Register("k8smtu", cmdK8sMTU)
 	cmd.Register("daemon", cmdDaemon)
+	cmd.Register("controller", cmdController)
+	cmd.Register("simulate", cmdSimulate)
+	cmd.Register("audit", cmdAudit)
+	cmd.Register("doctor", cmdDoctor)
+	cmd.Register("trace", cmdTrace)
+	cmd.Register("topology", cmdTopology)
 	os.Exit(cmd.Run(version))
 }
 
@@ -203,7 +209,21 @@ func cmdCIDR(ctx context.Context, args []string) int {
 }
 
 func cmdKernelRoutes(ctx context.Context, args []string) int {
-	h, err := util.NewRouteHandler(ctx, "kernel")
+	flagset := flag.NewFlagSet("kernelroutes", flag.ExitOnError)
+	protocol := flagset.String("protocol", "kernel", "Route protocol")
+	backend := flagset.String("backend", "netlink", "netlink|nexthop|ip")
+	table := flagset.Int("table", 0, "Routing table. 0 means main")
+	vrf := flagset.String("vrf", "", "List routes in the VRF table")
+	if err := flagset.Parse(args[1:]); err != nil {
+		log.Fatal(ctx, "Parse options", "error", err)
+	}
+	if *vrf != "" {
+		var err error
+		if *table, err = util.VrfTable(*vrf); err != nil {
+			log.Fatal(ctx, "util.VrfTable", "error", err)
+		}
+	}
+	h, err := util.NewRouteHandler(ctx, *backend, *protocol, *table)
 	if err != nil {
 		log.Fatal(ctx, "util.NewRouteHandler", "error", err)
 	}
@@ -252,14 +272,33 @@ func cmdK8sMTU(ctx context.Context, args []string) int {
 		return 1
 	}
 
+	adr, err := mtuAddress(n, os.Getenv("ADDRESS_ANNOTATION"))
+	if err != nil {
+		logger.Error(err, "Node address")
+		fmt.Println(1500)
+		return 1
+	}
+	mtu, err := util.GetMTU(adr)
+	if err != nil {
+		logger.Error(err, "GetMTU")
+		fmt.Println(mtu)
+		return 1
+	}
+
+	fmt.Println(mtu)
+	return 0
+}
+
+// mtuAddress Returns the node address used to find the MTU. If an
+// address annotation is specified, it is prioritized over the
+// InternalIP addresses in the node status
+func mtuAddress(n *k8s.Node, annotation string) (string, error) {
 	var nodeAddresses []string
-	annotation := os.Getenv("ADDRESS_ANNOTATION")
 	if annotation != "" {
-		// If an annotation is specified, it is prioritized
 		if a, ok := n.ObjectMeta.Annotations[annotation]; ok {
 			nodeAddresses = strings.Split(a, ",")
 		} else {
-			logger.Info("Annotation not found", "annotation", annotation)
+			return "", fmt.Errorf("Annotation not found %s", annotation)
 		}
 	} else {
 		// Get the node addresses from ".status.addresses"
@@ -270,20 +309,12 @@ func cmdK8sMTU(ctx context.Context, args []string) int {
 		}
 	}
 	if len(nodeAddresses) == 0 {
-		logger.Info("No node addresses found")
-		fmt.Println(1500)
-		return 1
+		return "", fmt.Errorf("No node addresses found")
 	}
 
 	// We assume that addresses of both families are on the same
-	// interface, so which address we use doesn't matter
-	mtu, err := util.GetMTU(nodeAddresses[0])
-	if err != nil {
-		logger.Error(err, "GetMTU")
-		fmt.Println(mtu)
-		return 1
-	}
-
-	fmt.Println(mtu)
-	return 0
+	// interface, so which address we use doesn't matter. A weight
+	// may be appended for multipath routes, and must be removed
+	adr, _, _ := strings.Cut(nodeAddresses[0], "*")
+	return strings.TrimSpace(adr), nil
 }
@@ -2,14 +2,29 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Nordix/xcluster-cni/pkg/log"
 	"github.com/Nordix/xcluster-cni/pkg/util"
 	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	k8s "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 /*
@@ -251,6 +266,277 @@ func TestRouteSync(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:        "Multipath routes",
+			syncHandler: &annotationHandler,
+			nodes: []k8s.Node{
+				{
+					ObjectMeta: meta.ObjectMeta{
+						Name: "peer",
+						Annotations: map[string]string{
+							cidrAnnotation:    "20.0.0.0/24,fd00:1000::0.0.0.0/96",
+							addressAnnotation: "192.168.1.1,192.168.2.1*3,fd00:1::192.168.1.1,fd00:2::192.168.2.1",
+						},
+					},
+				},
+			},
+			before: []util.Route{
+				{
+					Dst:     "20.0.0.0/24",
+					Gateway: "192.168.1.1",
+				},
+			},
+			after: []util.Route{
+				{
+					Dst: "20.0.0.0/24",
+					Nexthops: []util.Nexthop{
+						{Gateway: "192.168.2.1", Weight: 3},
+						{Gateway: "192.168.1.1"},
+					},
+				},
+				{
+					Dst: "fd00:1000::/96",
+					Nexthops: []util.Nexthop{
+						{Gateway: "fd00:1::c0a8:101"},
+						{Gateway: "fd00:2::c0a8:201"},
+					},
+				},
+			},
+		},
+		{
+			name:        "Invalid weight",
+			syncHandler: &annotationHandler,
+			nodes: []k8s.Node{
+				{
+					ObjectMeta: meta.ObjectMeta{
+						Name: "peer",
+						Annotations: map[string]string{
+							cidrAnnotation:    "20.0.0.0/24",
+							addressAnnotation: "192.168.1.1,192.168.2.1*0",
+						},
+					},
+				},
+			},
+			after: []util.Route{
+				{
+					Dst:     "20.0.0.0/24",
+					Gateway: "192.168.1.1",
+				},
+			},
+		},
+		{
+			name:        "Weight out of range",
+			syncHandler: &annotationHandler,
+			nodes: []k8s.Node{
+				{
+					ObjectMeta: meta.ObjectMeta{
+						Name: "peer",
+						Annotations: map[string]string{
+							cidrAnnotation:    "20.0.0.0/24",
+							addressAnnotation: "192.168.1.1*256,192.168.2.1*257",
+						},
+					},
+				},
+			},
+			after: []util.Route{
+				{
+					Dst:     "20.0.0.0/24",
+					Gateway: "192.168.1.1",
+				},
+			},
+		},
+		{
+			name: "Route attributes",
+			syncHandler: &syncHandler{
+				cidrAnnotation:    cidrAnnotation,
+				addressAnnotation: addressAnnotation,
+				src:               "auto",
+				metric:            100,
+				mtu:               1400,
+				localAddress: func(ip string) (string, error) {
+					if ip == "192.168.1.1" {
+						return "192.168.1.2", nil
+					}
+					return "", fmt.Errorf("Not found")
+				},
+			},
+			nodes: []k8s.Node{
+				{
+					ObjectMeta: meta.ObjectMeta{
+						Name: "peer",
+						Annotations: map[string]string{
+							cidrAnnotation:    "20.0.0.0/24,fd00:1000::0.0.0.0/96",
+							addressAnnotation: "192.168.1.1,fd00:1::192.168.1.1",
+						},
+					},
+				},
+			},
+			before: []util.Route{
+				{
+					Dst:     "20.0.0.0/24",
+					Gateway: "192.168.1.1",
+				},
+			},
+			after: []util.Route{
+				{
+					Dst:     "20.0.0.0/24",
+					Gateway: "192.168.1.1",
+					Src:     "192.168.1.2",
+					Metric:  100,
+					MTU:     1400,
+				},
+				{
+					Dst:     "fd00:1000::/96",
+					Gateway: "fd00:1::c0a8:101",
+					Metric:  100,
+					MTU:     1400,
+				},
+			},
+		},
+		{
+			name: "Configured source",
+			syncHandler: &syncHandler{
+				cidrAnnotation:    cidrAnnotation,
+				addressAnnotation: addressAnnotation,
+				src:               "192.168.1.2,fd00:1::2",
+			},
+			nodes: []k8s.Node{
+				{
+					ObjectMeta: meta.ObjectMeta{
+						Name: "peer",
+						Annotations: map[string]string{
+							cidrAnnotation:    "20.0.0.0/24,fd00:1000::0.0.0.0/96",
+							addressAnnotation: "192.168.1.1,fd00:1::192.168.1.1",
+						},
+					},
+				},
+			},
+			after: []util.Route{
+				{
+					Dst:     "20.0.0.0/24",
+					Gateway: "192.168.1.1",
+					Src:     "192.168.1.2",
+				},
+				{
+					Dst:     "fd00:1000::/96",
+					Gateway: "fd00:1::c0a8:101",
+					Src:     "fd00:1::2",
+				},
+			},
+		},
+		{
+			name: "Blackhole route for own CIDRs",
+			syncHandler: &syncHandler{
+				cidrAnnotation:    cidrAnnotation,
+				addressAnnotation: addressAnnotation,
+				ownCidrRoute:      "blackhole",
+			},
+			nodes: []k8s.Node{
+				{
+					ObjectMeta: meta.ObjectMeta{
+						Name: ownNode,
+						Annotations: map[string]string{
+							cidrAnnotation:    "10.0.0.0/24,fd00:1000::0.0.0.0/96",
+							addressAnnotation: "192.168.1.2,fd00:1::192.168.1.2",
+						},
+					},
+				},
+				{
+					ObjectMeta: meta.ObjectMeta{
+						Name: "peer",
+						Annotations: map[string]string{
+							cidrAnnotation:    "20.0.0.0/24",
+							addressAnnotation: "192.168.1.1",
+						},
+					},
+				},
+			},
+			before: []util.Route{
+				{
+					Type:   "unreachable",
+					Dst:    "10.0.0.0/24",
+					Metric: ownCidrMetric,
+				},
+			},
+			after: []util.Route{
+				{
+					Dst:     "20.0.0.0/24",
+					Gateway: "192.168.1.1",
+				},
+				{
+					Type:   "blackhole",
+					Dst:    "10.0.0.0/24",
+					Metric: ownCidrMetric,
+				},
+				{
+					Type:   "blackhole",
+					Dst:    "fd00:1000::/96",
+					Metric: ownCidrMetric,
+				},
+			},
+		},
+		{
+			name:        "Several CIDRs per family",
+			syncHandler: &annotationHandler,
+			nodes: []k8s.Node{
+				{
+					ObjectMeta: meta.ObjectMeta{
+						Name: "peer",
+						Annotations: map[string]string{
+							cidrAnnotation:    "20.0.0.0/24,fd00:1000::0.0.0.0/96,20.0.1.0/24,fd00:2000::/96,20.0.2.0/24",
+							addressAnnotation: "192.168.1.1,fd00:1::192.168.1.1",
+						},
+					},
+				},
+			},
+			after: []util.Route{
+				{
+					Dst:     "20.0.0.0/24",
+					Gateway: "192.168.1.1",
+				},
+				{
+					Dst:     "20.0.1.0/24",
+					Gateway: "192.168.1.1",
+				},
+				{
+					Dst:     "20.0.2.0/24",
+					Gateway: "192.168.1.1",
+				},
+				{
+					Dst:     "fd00:1000::/96",
+					Gateway: "fd00:1::c0a8:101",
+				},
+				{
+					Dst:     "fd00:2000::/96",
+					Gateway: "fd00:1::c0a8:101",
+				},
+			},
+		},
+		{
+			name:        "Invalid CIDR and missing family",
+			syncHandler: &annotationHandler,
+			nodes: []k8s.Node{
+				{
+					ObjectMeta: meta.ObjectMeta{
+						Name: "peer",
+						Annotations: map[string]string{
+							cidrAnnotation:    "20.0.0.0/24,20.0.1.0,fd00:1000::0.0.0.0/96,20.0.2.0/24",
+							addressAnnotation: "192.168.1.1",
+						},
+					},
+				},
+			},
+			after: []util.Route{
+				{
+					Dst:     "20.0.0.0/24",
+					Gateway: "192.168.1.1",
+				},
+				{
+					Dst:     "20.0.2.0/24",
+					Gateway: "192.168.1.1",
+				},
+			},
+		},
 	}
 
 	_ = os.Setenv("NODE_NAME", ownNode)
@@ -263,7 +549,7 @@ func TestRouteSync(t *testing.T) {
 			z, _ := log.ZapLogger("stderr", "trace")
 			ctx = log.NewContext(ctx, z)
 		}
-		if err := tc.syncHandler.syncRoutes(ctx, tc.nodes); err != nil {
+		if _, err := tc.syncHandler.syncRoutes(ctx, tc.nodes); err != nil {
 			t.Errorf("%s: Unexpected error %v", tc.name, err)
 		} else {
 			if !rh.sameRoutes(tc.after) {
@@ -274,9 +560,143 @@ func TestRouteSync(t *testing.T) {
 	}
 }
 
+func TestCheckRouteSrc(t *testing.T) {
+	tcases := []struct {
+		src   string
+		valid bool
+	}{
+		{src: "", valid: true},
+		{src: "auto", valid: true},
+		{src: "192.168.1.2", valid: true},
+		{src: "192.168.1.2, fd00:1::2", valid: true},
+		{src: "192.168.1.2*2", valid: false},
+		{src: "192.168.1.x", valid: false},
+		{src: "192.168.1.2,", valid: false},
+	}
+	for _, tc := range tcases {
+		if err := checkRouteSrc(tc.src); (err == nil) != tc.valid {
+			t.Errorf("%q: Unexpected error %v", tc.src, err)
+		}
+	}
+}
+
+func TestVrf(t *testing.T) {
+	const (
+		cidrAnnotation    = "cidr.nordix.org/eth2"
+		addressAnnotation = "addr.nordix.org/eth2"
+	)
+	var rh *testRouteHandler
+	var ruh *testRuleHandler
+	var routeTable, ruleTable int
+	defer func() {
+		newRouteHandler = util.NewRouteHandler
+		newRuleHandler = util.NewRuleHandler
+	}()
+	newRouteHandler = func(
+		ctx context.Context, backend, protocol string, table int) (util.RouteHandler, error) {
+		routeTable = table
+		rh = newTestRouteHandler(t, nil)
+		return rh, nil
+	}
+	newRuleHandler = func(
+		ctx context.Context, backend, protocol string, table, priority int) (util.RuleHandler, error) {
+		ruleTable = table
+		ruh = &testRuleHandler{}
+		return ruh, nil
+	}
+	nodes := []k8s.Node{
+		{
+			ObjectMeta: meta.ObjectMeta{
+				Name: "myself",
+				Annotations: map[string]string{
+					cidrAnnotation:    "10.0.1.0/24",
+					addressAnnotation: "192.168.1.1",
+				},
+			},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{
+				Name: "peer",
+				Annotations: map[string]string{
+					cidrAnnotation:    "10.0.2.0/24",
+					addressAnnotation: "192.168.1.2",
+				},
+			},
+		},
+	}
+	_ = os.Setenv("NODE_NAME", "myself")
+	ctx := context.TODO()
+
+	// A VRF network installs routes in its table, and adds no rules
+	h, r, err := newHandlers(ctx, "", "202", 10, "vrf-test", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if r != nil || ruh != nil {
+		t.Errorf("Rule handler created for a VRF")
+	}
+	if routeTable != 10 {
+		t.Errorf("Routes in table %d, expected 10", routeTable)
+	}
+	var vrf string
+	var vrfTable int
+	sh := syncHandler{
+		rh:                h,
+		ruh:               r,
+		cidrAnnotation:    cidrAnnotation,
+		addressAnnotation: addressAnnotation,
+		vrf:               "vrf-test",
+		vrfTable:          10,
+		setupVrf: func(
+			ctx context.Context, name string, table int, interfaces []string) error {
+			vrf, vrfTable = name, table
+			return nil
+		},
+	}
+	if _, err := sh.syncRoutes(ctx, nodes); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if vrf != "vrf-test" || vrfTable != 10 {
+		t.Errorf("Unexpected VRF %s, table %d", vrf, vrfTable)
+	}
+	if !rh.sameRoutes([]util.Route{{Dst: "10.0.2.0/24", Gateway: "192.168.1.2"}}) {
+		t.Errorf("Unexpected routes %v", rh.routes)
+	}
+
+	// A table without a VRF uses policy routing rules
+	if _, r, err = newHandlers(ctx, "", "202", 10, "", 0); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if r == nil || ruleTable != 10 {
+		t.Errorf("No rule handler for table 10")
+	}
+	sh = syncHandler{
+		rh:                rh,
+		ruh:               r,
+		cidrAnnotation:    cidrAnnotation,
+		addressAnnotation: addressAnnotation,
+	}
+	if _, err := sh.syncRoutes(ctx, nodes); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := []util.Rule{{Src: "10.0.1.0/24"}, {Dst: "10.0.2.0/24"}}
+	if len(ruh.rules) != len(expected) {
+		t.Errorf("Unexpected rules %v", ruh.rules)
+	}
+	for _, r := range expected {
+		if !containsRule(ruh.rules, &r) {
+			t.Errorf("Missing rule %v", r)
+		}
+	}
+}
+
 type testRouteHandler struct {
 	routes map[string]util.Route
 	t      *testing.T
+	// fail Set and Delete of these destinations return an error
+	fail map[string]bool
+	// drop Set of these destinations succeeds but the route is lost
+	drop map[string]bool
 }
 
 func newTestRouteHandler(t *testing.T, routes []util.Route) *testRouteHandler {
@@ -295,7 +715,12 @@ func (t *testRouteHandler) Set(
 	ctx context.Context, route *util.Route) error {
 	logger := logr.FromContextOrDiscard(ctx).V(2)
 	logger.Info("Route Set", "route", route)
-	t.routes[route.Dst] = *route
+	if t.fail[route.Dst] {
+		return fmt.Errorf("Set failed")
+	}
+	if !t.drop[route.Dst] {
+		t.routes[route.Dst] = *route
+	}
 	return nil
 }
 
@@ -303,6 +728,9 @@ func (t *testRouteHandler) Delete(
 	ctx context.Context, route *util.Route) error {
 	logger := logr.FromContextOrDiscard(ctx).V(2)
 	logger.Info("Route Delete", "route", route)
+	if t.fail[route.Dst] {
+		return fmt.Errorf("Delete failed")
+	}
 	delete(t.routes, route.Dst)
 	return nil
 }
@@ -333,3 +761,1844 @@ func (t *testRouteHandler) sameRoutes(routes []util.Route) bool {
 	}
 	return true
 }
+
+// testNodeHandler A util.Handler with fixed nodes
+type testNodeHandler struct {
+	nodes  []k8s.Node
+	synced bool
+}
+
+func (h *testNodeHandler) List() []interface{} {
+	l := make([]interface{}, len(h.nodes))
+	for i := range h.nodes {
+		l[i] = &h.nodes[i]
+	}
+	return l
+}
+
+func (h *testNodeHandler) HasSynced() bool {
+	return h.synced
+}
+
+// testCidrAnnotation The CIDR annotation of nodes from testNode
+const testCidrAnnotation = "cidr.nordix.org/eth2"
+
+// testNode Returns a node with the POD CIDRs in testCidrAnnotation,
+// and the addresses as InternalIP addresses
+func testNode(name, cidrs string, addresses ...string) k8s.Node {
+	n := k8s.Node{ObjectMeta: meta.ObjectMeta{
+		Name:        name,
+		Annotations: map[string]string{testCidrAnnotation: cidrs},
+	}}
+	for _, a := range addresses {
+		n.Status.Addresses = append(n.Status.Addresses,
+			k8s.NodeAddress{Type: "InternalIP", Address: a})
+	}
+	return n
+}
+
+func TestParseAddress(t *testing.T) {
+	tcases := []struct {
+		address string
+		ip      string
+		weight  int
+		err     string
+	}{
+		{address: "192.168.1.1", ip: "192.168.1.1"},
+		{address: " fd00::1 ", ip: "fd00::1"},
+		{address: "192.168.1.1*1", ip: "192.168.1.1", weight: 1},
+		{address: "192.168.1.1*256", ip: "192.168.1.1", weight: 256},
+		{address: "192.168.1.1*0", err: "Weight not in 1..256, address 192.168.1.1*0"},
+		{address: "192.168.1.1*257", err: "Weight not in 1..256, address 192.168.1.1*257"},
+		{address: "192.168.1.1*x", err: "Weight not in 1..256, address 192.168.1.1*x"},
+		{address: "1000::x", err: "Parse failed, address 1000::x"},
+	}
+	for _, tc := range tcases {
+		ip, weight, err := parseAddress(tc.address)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: Unexpected error %v", tc.address, err)
+			}
+			if ip != nil {
+				t.Errorf("%s: Unexpected address %s", tc.address, ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error %v", tc.address, err)
+			continue
+		}
+		if ip.String() != tc.ip || weight != tc.weight {
+			t.Errorf("%s: Unexpected %s, weight %d", tc.address, ip, weight)
+		}
+	}
+
+	// A node with an invalid weight is routed via its other addresses,
+	// and the problem is reported
+	h := syncHandler{addressAnnotation: "adr"}
+	node := k8s.Node{ObjectMeta: meta.ObjectMeta{
+		Name:        "vm-002",
+		Annotations: map[string]string{"adr": "192.168.1.2,192.168.2.2*300"},
+	}}
+	node.Spec.PodCIDRs = []string{"10.0.2.0/24"}
+	var result syncResult
+	want := h.wantedRoutes(context.TODO(), []k8s.Node{node}, "vm-001", &result)
+	if r, ok := want["10.0.2.0/24"]; !ok || r.Gateway != "192.168.1.2" {
+		t.Errorf("Unexpected routes %v", want)
+	}
+	expected := []nodeProblem{{Node: "vm-002", Reason: reasonAddressParseFailed,
+		Message: "Weight not in 1..256, address 192.168.2.2*300"}}
+	if !reflect.DeepEqual(result.Problems, expected) {
+		t.Errorf("Unexpected problems %v", result.Problems)
+	}
+}
+
+func TestEmptyAnnotations(t *testing.T) {
+	h := syncHandler{cidrAnnotation: "cidr", addressAnnotation: "adr"}
+	nodes := []k8s.Node{
+		{ObjectMeta: meta.ObjectMeta{
+			Name:        "vm-002",
+			Annotations: map[string]string{"cidr": "10.0.2.0/24", "adr": ""},
+		}},
+		{ObjectMeta: meta.ObjectMeta{
+			Name:        "vm-003",
+			Annotations: map[string]string{"cidr": "", "adr": "192.168.1.3"},
+		}},
+	}
+	var result syncResult
+	want := h.wantedRoutes(context.TODO(), nodes, "vm-001", &result)
+	if len(want) != 0 {
+		t.Errorf("Unexpected routes %v", want)
+	}
+	expected := []nodeProblem{
+		{Node: "vm-002", Reason: reasonNoNodeAddresses, Message: "No node addresses"},
+		{Node: "vm-003", Reason: reasonNoPodCidrs, Message: "No POD CIDRs"},
+	}
+	if !reflect.DeepEqual(result.Problems, expected) {
+		t.Errorf("Unexpected problems %v", result.Problems)
+	}
+}
+
+func TestRouteFailures(t *testing.T) {
+	const (
+		cidrAnnotation    = "cidr.nordix.org/eth2"
+		addressAnnotation = "addr.nordix.org/eth2"
+	)
+	nodes := []k8s.Node{
+		{
+			ObjectMeta: meta.ObjectMeta{
+				Name: "peer1",
+				Annotations: map[string]string{
+					cidrAnnotation:    "20.0.0.0/24",
+					addressAnnotation: "192.168.1.1",
+				},
+			},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{
+				Name: "peer2",
+				Annotations: map[string]string{
+					cidrAnnotation:    "20.0.1.0/24",
+					addressAnnotation: "192.168.1.2",
+				},
+			},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{
+				Name: "peer3",
+				Annotations: map[string]string{
+					cidrAnnotation:    "20.0.2.0/24",
+					addressAnnotation: "192.168.1.3",
+				},
+			},
+		},
+	}
+	rh := newTestRouteHandler(t, []util.Route{
+		{Dst: "30.0.0.0/24", Gateway: "192.168.1.9"},
+	})
+	rh.fail = map[string]bool{"20.0.0.0/24": true, "30.0.0.0/24": true}
+	rh.drop = map[string]bool{"20.0.1.0/24": true}
+	h := syncHandler{
+		cidrAnnotation:    cidrAnnotation,
+		addressAnnotation: addressAnnotation,
+		rh:                rh,
+	}
+	_ = os.Setenv("NODE_NAME", "myself")
+	ctx := context.TODO()
+	result, err := h.syncRoutes(ctx, nodes)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result.Routes != 3 || result.Added != 2 || result.Deleted != 0 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	expected := map[string]string{
+		"20.0.0.0/24": "set",
+		"20.0.1.0/24": "verify",
+		"30.0.0.0/24": "delete",
+	}
+	if len(result.Failures) != len(expected) {
+		t.Fatalf("Unexpected failures %+v", result.Failures)
+	}
+	for _, f := range result.Failures {
+		if f.Route == nil || expected[f.Route.Dst] != f.Op {
+			t.Errorf("Unexpected failure %+v", f)
+		}
+	}
+
+	// Retry when the problems are gone
+	rh.fail = nil
+	rh.drop = nil
+	if result, err = h.syncRoutes(ctx, nodes); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(result.Failures) != 0 || result.Added != 2 || result.Deleted != 1 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	// With nexthop objects, a route that doesn't refer to a nexthop
+	// object fails verification
+	nh := &testNexthopHandler{
+		testRouteHandler: newTestRouteHandler(t, nil),
+		noNhid:           map[string]bool{"20.0.2.0/24": true},
+	}
+	h.rh = nh
+	if result, err = h.syncRoutes(ctx, nodes); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(result.Failures) != 1 || result.Failures[0].Op != "verify" ||
+		result.Failures[0].Route.Dst != "20.0.2.0/24" {
+		t.Errorf("Unexpected failures %+v", result.Failures)
+	}
+}
+
+// testNexthopHandler A testRouteHandler that uses nexthop objects.
+// Routes refer to nexthop id 1, except the "noNhid" destinations
+type testNexthopHandler struct {
+	*testRouteHandler
+	noNhid map[string]bool
+}
+
+func (t *testNexthopHandler) GetRoutes(
+	ctx context.Context) ([]util.Route, error) {
+	routes, err := t.testRouteHandler.GetRoutes(ctx)
+	for i := range routes {
+		if !t.noNhid[routes[i].Dst] {
+			routes[i].NexthopID = 1
+		}
+	}
+	return routes, err
+}
+
+func (t *testNexthopHandler) PruneNexthops(ctx context.Context) error {
+	return nil
+}
+
+func TestDryRun(t *testing.T) {
+	const (
+		cidrAnnotation    = "cidr.nordix.org/eth2"
+		addressAnnotation = "addr.nordix.org/eth2"
+	)
+	nodes := []k8s.Node{
+		{
+			ObjectMeta: meta.ObjectMeta{
+				Name: "peer1",
+				Annotations: map[string]string{
+					cidrAnnotation:    "20.0.0.0/24",
+					addressAnnotation: "192.168.1.1",
+				},
+			},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{
+				Name: "peer2",
+				Annotations: map[string]string{
+					cidrAnnotation:    "20.0.1.0/24",
+					addressAnnotation: "192.168.1.2",
+				},
+			},
+		},
+	}
+	before := []util.Route{
+		{Dst: "20.0.1.0/24", Gateway: "192.168.1.9"},
+		{Dst: "30.0.0.0/24", Gateway: "192.168.1.9"},
+	}
+	rh := newTestRouteHandler(t, before)
+	h := syncHandler{
+		cidrAnnotation:    cidrAnnotation,
+		addressAnnotation: addressAnnotation,
+		rh:                rh,
+		ruh:               &testRuleHandler{},
+		dryRun:            true,
+	}
+	_ = os.Setenv("NODE_NAME", "myself")
+	result, err := h.syncRoutes(context.TODO(), nodes)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !rh.sameRoutes(before) {
+		t.Errorf("Routes changed in dry-run")
+	}
+	plan := result.Plan
+	if len(plan.Add) != 1 || plan.Add[0].Dst != "20.0.0.0/24" {
+		t.Errorf("Unexpected add %v", plan.Add)
+	}
+	if len(plan.Replace) != 1 || plan.Replace[0].To.Gateway != "192.168.1.2" ||
+		plan.Replace[0].From.Gateway != "192.168.1.9" {
+		t.Errorf("Unexpected replace %v", plan.Replace)
+	}
+	if len(plan.Delete) != 1 || plan.Delete[0].Dst != "30.0.0.0/24" {
+		t.Errorf("Unexpected delete %v", plan.Delete)
+	}
+	if result.Added != 0 || result.Replaced != 0 || result.Deleted != 0 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+}
+
+func TestDeleteGuard(t *testing.T) {
+	const (
+		cidrAnnotation    = "cidr.nordix.org/eth2"
+		addressAnnotation = "addr.nordix.org/eth2"
+	)
+	nodes := []k8s.Node{
+		{
+			ObjectMeta: meta.ObjectMeta{
+				Name: "peer1",
+				Annotations: map[string]string{
+					cidrAnnotation:    "20.0.0.0/24",
+					addressAnnotation: "192.168.1.1",
+				},
+			},
+		},
+	}
+	before := []util.Route{
+		{Dst: "20.0.0.0/24", Gateway: "192.168.1.1"},
+		{Dst: "20.0.1.0/24", Gateway: "192.168.1.2"},
+		{Dst: "20.0.2.0/24", Gateway: "192.168.1.3"},
+		{Dst: "20.0.3.0/24", Gateway: "192.168.1.4"},
+	}
+	override := filepath.Join(t.TempDir(), "allow-delete")
+	tcases := []struct {
+		name      string
+		nodes     []k8s.Node
+		share     int
+		period    time.Duration
+		since     time.Duration // Condition detected this long ago
+		override  bool
+		before    []util.Route // Default is 4 routes
+		minRoutes int
+		refused   int
+	}{
+		{
+			name:  "Guard disabled",
+			nodes: nodes,
+		},
+		{
+			name:    "Too many deletions",
+			nodes:   nodes,
+			share:   50,
+			refused: 3,
+		},
+		{
+			name:  "Deletions within share",
+			nodes: nodes,
+			share: 75,
+		},
+		{
+			name:    "No routes left",
+			share:   100,
+			refused: 4,
+		},
+		{
+			name:    "Period not passed",
+			nodes:   nodes,
+			share:   50,
+			period:  time.Minute,
+			since:   time.Second,
+			refused: 3,
+		},
+		{
+			name:   "Period passed",
+			nodes:  nodes,
+			share:  50,
+			period: time.Minute,
+			since:  time.Minute * 2,
+		},
+		{
+			name:   "Few routes",
+			share:  100,
+			before: before[:deleteGuardMinRoutes-1],
+		},
+		{
+			name:      "Few routes, minimum configured",
+			share:     100,
+			before:    before[:deleteGuardMinRoutes-1],
+			minRoutes: 2,
+			refused:   deleteGuardMinRoutes - 1,
+		},
+		{
+			name:  "Own routes not counted",
+			share: 100,
+			before: append(before[:deleteGuardMinRoutes-1:deleteGuardMinRoutes-1],
+				util.Route{Dst: "10.0.0.0/24", Type: "blackhole"}),
+		},
+		{
+			name:   "Last route",
+			share:  50,
+			before: before[:1],
+		},
+		{
+			name:     "Override",
+			share:    50,
+			override: true,
+		},
+	}
+	_ = os.Setenv("NODE_NAME", "myself")
+	for _, tc := range tcases {
+		if tc.before == nil {
+			tc.before = before
+		}
+		rh := newTestRouteHandler(t, tc.before)
+		h := syncHandler{
+			cidrAnnotation:    cidrAnnotation,
+			addressAnnotation: addressAnnotation,
+			rh:                rh,
+			deleteGuard: deleteGuard{
+				share:     tc.share,
+				minRoutes: tc.minRoutes,
+				period:    tc.period,
+				override:  override,
+			},
+		}
+		if tc.since != 0 {
+			h.deleteGuard.since = time.Now().Add(-tc.since)
+		}
+		if tc.override {
+			if err := os.WriteFile(override, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		result, err := h.syncRoutes(context.TODO(), tc.nodes)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error %v", tc.name, err)
+		}
+		if result.Refused != tc.refused {
+			t.Errorf("%s: Refused %d, expected %d", tc.name, result.Refused, tc.refused)
+		}
+		if len(rh.routes) != len(tc.before)-result.Deleted || result.Deleted+tc.refused != len(tc.before)-len(tc.nodes) {
+			t.Errorf("%s: Unexpected routes %v", tc.name, rh.routes)
+		}
+		if _, err := os.Stat(override); err == nil {
+			t.Errorf("%s: Override file not removed", tc.name)
+		}
+	}
+}
+
+func TestRuleSync(t *testing.T) {
+	const (
+		cidrAnnotation    = "cidr.nordix.org/eth2"
+		addressAnnotation = "addr.nordix.org/eth2"
+		ownNode           = "myself"
+	)
+	nodes := []k8s.Node{
+		{
+			ObjectMeta: meta.ObjectMeta{
+				Name: ownNode,
+				Annotations: map[string]string{
+					cidrAnnotation:    "10.0.0.0/24,fd00:1000::0.0.0.0/96",
+					addressAnnotation: "192.168.1.2,fd00:1::192.168.1.2",
+				},
+			},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{
+				Name: "peer",
+				Annotations: map[string]string{
+					cidrAnnotation:    "20.0.0.0/24",
+					addressAnnotation: "192.168.1.1",
+				},
+			},
+		},
+	}
+	ruh := &testRuleHandler{
+		rules: []util.Rule{
+			{Dst: "30.0.0.0/24"},
+			{Src: "10.0.0.0/24"},
+		},
+	}
+	h := syncHandler{
+		cidrAnnotation:    cidrAnnotation,
+		addressAnnotation: addressAnnotation,
+		rh:                newTestRouteHandler(t, nil),
+		ruh:               ruh,
+	}
+	_ = os.Setenv("NODE_NAME", ownNode)
+	ctx := context.TODO()
+	if _, err := h.syncRoutes(ctx, nodes); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := []util.Rule{
+		{Src: "10.0.0.0/24"},
+		{Src: "fd00:1000::/96"},
+		{Dst: "20.0.0.0/24"},
+	}
+	if len(ruh.rules) != len(expected) {
+		t.Fatalf("Invalid rules after sync: %v", ruh.rules)
+	}
+	for _, r := range expected {
+		if !containsRule(ruh.rules, &r) {
+			t.Errorf("Rule missing: %v", r)
+		}
+	}
+	if err := h.deleteRules(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(ruh.rules) != 0 {
+		t.Errorf("Rules not deleted: %v", ruh.rules)
+	}
+}
+
+type testRuleHandler struct {
+	rules []util.Rule
+}
+
+func (t *testRuleHandler) Add(ctx context.Context, rule *util.Rule) error {
+	t.rules = append(t.rules, *rule)
+	return nil
+}
+
+func (t *testRuleHandler) Delete(ctx context.Context, rule *util.Rule) error {
+	for i := range t.rules {
+		if util.RulesEqual(&t.rules[i], rule) {
+			t.rules = append(t.rules[:i], t.rules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("Rule not found")
+}
+
+func (t *testRuleHandler) GetRules(ctx context.Context) ([]util.Rule, error) {
+	return append([]util.Rule{}, t.rules...), nil
+}
+
+func TestParseConfig(t *testing.T) {
+	tcases := []struct {
+		name     string
+		config   string
+		networks int
+		err      bool
+	}{
+		{
+			name:   "Empty",
+			config: "",
+		},
+		{
+			name: "Yaml",
+			config: `
+networks:
+  - name: net3
+    cidrAnnotation: cidr.example.com/net3
+    addressAnnotation: adr.example.com/net3
+  - name: net4
+    protocol: "201"
+    table: 201
+    deleteGuardShare: 50
+    deleteGuardPeriod: 10m
+`,
+			networks: 2,
+		},
+		{
+			name:     "Json",
+			config:   `{"networks":[{"name":"net3","protocol":"200","vrf":"vrf3","table":3}]}`,
+			networks: 1,
+		},
+		{
+			name:   "No name",
+			config: `{"networks":[{"protocol":"200"}]}`,
+			err:    true,
+		},
+		{
+			name:   "Duplicate name",
+			config: `{"networks":[{"name":"a","protocol":"200"},{"name":"a","protocol":"201"}]}`,
+			err:    true,
+		},
+		{
+			name:   "Same protocol",
+			config: `{"networks":[{"name":"a"},{"name":"b"}]}`,
+			err:    true,
+		},
+		{
+			name:   "Unknown field",
+			config: `{"networks":[{"name":"a","protocl":"200"}]}`,
+			err:    true,
+		},
+		{
+			name:   "VRF without table",
+			config: `{"networks":[{"name":"a","vrf":"vrf3"}]}`,
+			err:    true,
+		},
+		{
+			name:   "Invalid period",
+			config: `{"networks":[{"name":"a","deleteGuardPeriod":"soon"}]}`,
+			err:    true,
+		},
+		{
+			name:   "Invalid min routes",
+			config: `{"networks":[{"name":"a","deleteGuardMinRoutes":-1}]}`,
+			err:    true,
+		},
+		{
+			name:   "Invalid source",
+			config: `{"networks":[{"name":"a","routeSrc":"192.168.1.2*2"}]}`,
+			err:    true,
+		},
+	}
+	for _, tc := range tcases {
+		cfg, err := parseConfig([]byte(tc.config))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: Expected error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error %v", tc.name, err)
+			continue
+		}
+		if len(cfg.Networks) != tc.networks {
+			t.Errorf("%s: Unexpected networks %v", tc.name, cfg.Networks)
+		}
+		for _, n := range cfg.Networks {
+			if n.Protocol == "" {
+				t.Errorf("%s: No default protocol", tc.name)
+			}
+		}
+	}
+}
+
+func TestApplyFailed(t *testing.T) {
+	nw := networks{items: make(map[string]*network)}
+	cfg := daemonConfig{Networks: []networkConfig{
+		{Name: "net3", Protocol: "203", RouteHandler: "bogus"},
+	}}
+	ctx := context.TODO()
+	if err := nw.apply(ctx, &cfg); err == nil {
+		t.Errorf("Start of an invalid network accepted")
+	}
+	if len(nw.items) != 0 || nw.failed["net3"] == nil {
+		t.Errorf("Unexpected items %v, failed %v", nw.items, nw.failed)
+	}
+	// A failed network is forgotten when it's removed from the config
+	if err := nw.apply(ctx, &daemonConfig{}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(nw.failed) != 0 {
+		t.Errorf("Unexpected failed %v", nw.failed)
+	}
+}
+
+func TestNodeSelector(t *testing.T) {
+	const (
+		cidrAnnotation    = "cidr.nordix.org/eth2"
+		addressAnnotation = "addr.nordix.org/eth2"
+	)
+	node := func(name, net string, cidr, addr string) k8s.Node {
+		n := k8s.Node{
+			ObjectMeta: meta.ObjectMeta{
+				Name: name,
+				Annotations: map[string]string{
+					cidrAnnotation:    cidr,
+					addressAnnotation: addr,
+				},
+			},
+		}
+		if net != "" {
+			n.ObjectMeta.Labels = map[string]string{"net": net}
+		}
+		return n
+	}
+	nodes := []k8s.Node{
+		node("myself", "red", "20.0.0.0/24", "192.168.1.0"),
+		node("peer1", "red", "20.0.1.0/24", "192.168.1.1"),
+		node("peer2", "blue", "20.0.2.0/24", "192.168.1.2"),
+		node("peer3", "", "20.0.3.0/24", "192.168.1.3"),
+	}
+	tcases := []struct {
+		name     string
+		selector string
+		routes   int
+	}{
+		{name: "All nodes", routes: 3},
+		{name: "Red nodes", selector: "net=red", routes: 1},
+		{name: "Own node not selected", selector: "net=blue", routes: 0},
+		{name: "Labeled nodes", selector: "net", routes: 2},
+	}
+	_ = os.Setenv("NODE_NAME", "myself")
+	for _, tc := range tcases {
+		c := networkConfig{
+			Name:              "test",
+			Protocol:          defaultProtocol,
+			CidrAnnotation:    cidrAnnotation,
+			AddressAnnotation: addressAnnotation,
+		}
+		if tc.selector != "" {
+			s, err := meta.ParseToLabelSelector(tc.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.NodeSelector = s
+		}
+		h, err := newSyncHandler(context.TODO(), &c, false)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error %v", tc.name, err)
+		}
+		rh := newTestRouteHandler(t, nil)
+		h.rh = rh
+		result, err := h.syncRoutes(context.TODO(), nodes)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error %v", tc.name, err)
+		}
+		if len(rh.routes) != tc.routes || result.Nodes != tc.routes {
+			t.Errorf("%s: Unexpected routes %v", tc.name, rh.routes)
+		}
+	}
+}
+
+func TestXclusterNetwork(t *testing.T) {
+	u := map[string]interface{}{
+		"apiVersion": "xcluster.nordix.org/v1alpha1",
+		"kind":       "XclusterNetwork",
+		"metadata": map[string]interface{}{
+			"name": "net3",
+		},
+		"spec": map[string]interface{}{
+			"protocol":       "200",
+			"cidrAnnotation": "cidr.example.com/net3",
+			"table":          int64(3),
+			"nodeSelector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{"net3": "yes"},
+			},
+		},
+	}
+	var xn xclusterNetwork
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u, &xn); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	n := xn.Spec
+	n.Name = xn.Name
+	var nv networkValidator
+	if err := nv.check(&n); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if n.Name != "net3" || n.Protocol != "200" || n.Table != 3 ||
+		n.NodeSelector.MatchLabels["net3"] != "yes" {
+		t.Errorf("Unexpected network %+v", n)
+	}
+	other := networkConfig{Name: "net4", Protocol: "200"}
+	if err := nv.check(&other); err == nil {
+		t.Errorf("Same protocol accepted")
+	}
+}
+
+func TestNetworkStatus(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "xcluster.nordix.org/v1alpha1",
+		"kind":       "XclusterNetwork",
+		"metadata": map[string]interface{}{
+			"name": "net3",
+		},
+		"status": map[string]interface{}{
+			"nodes": map[string]interface{}{
+				"deleted": map[string]interface{}{"routes": int64(2)},
+			},
+		},
+	}}
+	client := dynfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{networkGVR: "XclusterNetworkList"},
+		obj.DeepCopy())
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if err := store.Add(obj); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	h := &testNodeHandler{synced: true, nodes: []k8s.Node{
+		{ObjectMeta: meta.ObjectMeta{Name: "myself"}},
+	}}
+	w := networkWatcher{
+		client: client.Resource(networkGVR),
+		nw:     &networks{h: h},
+		node:   "myself",
+		store:  store,
+	}
+	tcases := []struct {
+		name    string
+		result  *syncResult
+		err     error
+		patches int
+		routes  int64
+		errors  int
+	}{
+		{
+			name:    "First sync",
+			result:  &syncResult{Nodes: 2, Routes: 4},
+			patches: 1,
+			routes:  4,
+		},
+		{
+			name:    "Unchanged",
+			result:  &syncResult{Nodes: 2, Routes: 4},
+			patches: 1,
+			routes:  4,
+		},
+		{
+			name:    "Failures",
+			result:  &syncResult{Nodes: 2, Routes: 4, Failures: []syncFailure{{Op: "set"}}},
+			patches: 2,
+			routes:  4,
+			errors:  1,
+		},
+		{
+			name:    "Recovered",
+			result:  &syncResult{Nodes: 2, Routes: 4},
+			patches: 3,
+			routes:  4,
+		},
+	}
+	ctx := context.TODO()
+	patches := func() int {
+		cnt := 0
+		for _, a := range client.Actions() {
+			if a.GetVerb() == "patch" {
+				cnt++
+			}
+		}
+		return cnt
+	}
+	for _, tc := range tcases {
+		w.writeStatus(ctx, "net3", tc.result, tc.err)
+		if cnt := patches(); cnt != tc.patches {
+			t.Errorf("%s: Expected %d patches, got %d", tc.name, tc.patches, cnt)
+		}
+		u, err := w.client.Get(ctx, "net3", meta.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: Unexpected error %v", tc.name, err)
+		}
+		routes, _, _ := unstructured.NestedInt64(u.Object, "status", "nodes", "myself", "routes")
+		errors, _, _ := unstructured.NestedStringSlice(u.Object, "status", "nodes", "myself", "errors")
+		if routes != tc.routes || len(errors) != tc.errors {
+			t.Errorf("%s: Unexpected status %v", tc.name, u.Object["status"])
+		}
+	}
+
+	// The status of a deleted node is removed, once
+	w.removeDeletedNodes(ctx)
+	u, err := w.client.Get(ctx, "net3", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	nodes, _, _ := unstructured.NestedMap(u.Object, "status", "nodes")
+	if _, ok := nodes["deleted"]; ok || len(nodes) != 1 {
+		t.Errorf("Unexpected nodes in status %v", nodes)
+	}
+	if err := store.Update(u); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	cnt := patches()
+	w.removeDeletedNodes(ctx)
+	if patches() != cnt {
+		t.Errorf("Status patched without deleted nodes")
+	}
+}
+
+func TestPublishAddresses(t *testing.T) {
+	const annotation = "addr.nordix.org/eth2"
+	node := k8s.Node{
+		ObjectMeta: meta.ObjectMeta{
+			Name: "myself",
+			Annotations: map[string]string{
+				annotation: "192.168.1.1",
+			},
+		},
+	}
+	tcases := []struct {
+		name     string
+		local    []string
+		dryRun   bool
+		expected string
+	}{
+		{name: "Same address", local: []string{"192.168.1.1"}, expected: "192.168.1.1"},
+		{name: "No addresses", expected: "192.168.1.1"},
+		{name: "Dry-run", local: []string{"192.168.1.2"}, dryRun: true, expected: "192.168.1.1"},
+		{name: "Dual-stack", local: []string{"192.168.1.2", "fd00::192.168.1.2"},
+			expected: "192.168.1.2,fd00::192.168.1.2"},
+	}
+	_ = os.Setenv("NODE_NAME", "myself")
+	for _, tc := range tcases {
+		client := fake.NewSimpleClientset(node.DeepCopy())
+		p := addressPublisher{
+			client:     client,
+			annotation: annotation,
+			iface:      "eth2",
+			dryRun:     tc.dryRun,
+			localAddresses: func(iface string, subnets []string) ([]string, error) {
+				return tc.local, nil
+			},
+		}
+		ctx := context.TODO()
+		if err := p.publish(ctx, []k8s.Node{node}); err != nil {
+			t.Fatalf("%s: Unexpected error %v", tc.name, err)
+		}
+		n, err := client.CoreV1().Nodes().Get(ctx, "myself", meta.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: Unexpected error %v", tc.name, err)
+		}
+		if v := n.ObjectMeta.Annotations[annotation]; v != tc.expected {
+			t.Errorf("%s: Annotation %s, expected %s", tc.name, v, tc.expected)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	const annotation = "cidr.nordix.org/eth2"
+	node := func(name, cidrs string) k8s.Node {
+		n := k8s.Node{ObjectMeta: meta.ObjectMeta{Name: name}}
+		if cidrs != "" {
+			n.ObjectMeta.Annotations = map[string]string{annotation: cidrs}
+		}
+		return n
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	tcases := []struct {
+		name        string
+		allocations map[string]uint
+		released    map[uint]time.Time
+		nodes       []k8s.Node
+		expected    map[string]uint
+		expReleased []uint
+	}{
+		{
+			name:     "New nodes sorted by name",
+			nodes:    []k8s.Node{node("vm-003", ""), node("vm-002", "")},
+			expected: map[string]uint{"vm-002": 0, "vm-003": 1},
+		},
+		{
+			name:        "Deleted node released",
+			allocations: map[string]uint{"vm-002": 0, "vm-003": 1},
+			nodes:       []k8s.Node{node("vm-003", ""), node("vm-004", "")},
+			expected:    map[string]uint{"vm-003": 1, "vm-004": 0},
+		},
+		{
+			name:        "Released number held",
+			allocations: map[string]uint{"vm-002": 0, "vm-003": 1},
+			released:    map[uint]time.Time{2: hourAgo},
+			nodes:       []k8s.Node{node("vm-003", ""), node("vm-004", "")},
+			expected:    map[string]uint{"vm-003": 1, "vm-004": 3},
+			expReleased: []uint{0, 2},
+		},
+		{
+			name:        "Released number expired",
+			allocations: map[string]uint{"vm-003": 1},
+			released:    map[uint]time.Time{0: hourAgo.Add(-time.Hour)},
+			nodes:       []k8s.Node{node("vm-003", ""), node("vm-004", "")},
+			expected:    map[string]uint{"vm-003": 1, "vm-004": 0},
+		},
+		{
+			name:     "Adopt annotation",
+			nodes:    []k8s.Node{node("vm-002", ""), node("vm-003", "10.0.2.0/24,fd00::2:0/112")},
+			expected: map[string]uint{"vm-002": 0, "vm-003": 2},
+		},
+		{
+			name:        "Annotated CIDR in use",
+			allocations: map[string]uint{"vm-002": 1},
+			nodes: []k8s.Node{node("vm-002", "10.0.0.0/24"),
+				node("vm-003", "10.0.0.0/24"), node("vm-004", "")},
+			expected: map[string]uint{"vm-002": 1, "vm-003": 2, "vm-004": 3},
+		},
+		{
+			name: "No free CIDRs",
+			nodes: []k8s.Node{node("vm-001", ""), node("vm-002", ""),
+				node("vm-003", ""), node("vm-004", ""), node("vm-005", "")},
+			expected: map[string]uint{"vm-001": 0, "vm-002": 1, "vm-003": 2, "vm-004": 3},
+		},
+	}
+	for _, tc := range tcases {
+		a := nodeAllocator{
+			networks: []networkConfig{{
+				Name:           "default",
+				CidrAnnotation: annotation,
+				AllocateCidrs:  []string{"10.0.0.0/22/24", "fd00::/110/112"},
+			}},
+			allocations: tc.allocations,
+			released:    tc.released,
+		}
+		if tc.released != nil {
+			a.releaseGrace = time.Hour + time.Minute
+		}
+		alloc, released := a.allocate(context.TODO(), tc.nodes)
+		if !reflect.DeepEqual(alloc, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, alloc)
+		}
+		if len(released) != len(tc.expReleased) {
+			t.Errorf("%s: Unexpected released %v", tc.name, released)
+		}
+		for _, no := range tc.expReleased {
+			if _, ok := released[no]; !ok {
+				t.Errorf("%s: Not released %d", tc.name, no)
+			}
+		}
+	}
+}
+
+func TestAllocatorReconcile(t *testing.T) {
+	const annotation = "cidr.nordix.org/eth2"
+	nodes := []k8s.Node{
+		{ObjectMeta: meta.ObjectMeta{Name: "vm-002"}},
+		{ObjectMeta: meta.ObjectMeta{Name: "vm-003"}},
+	}
+	client := fake.NewSimpleClientset(nodes[0].DeepCopy(), nodes[1].DeepCopy())
+	a := nodeAllocator{
+		client:    client,
+		namespace: "kube-system",
+		name:      defaultAllocations,
+		networks: []networkConfig{{
+			Name:           "default",
+			CidrAnnotation: annotation,
+			AllocateCidrs:  []string{"10.0.0.0/16/24"},
+		}},
+	}
+	ctx := context.TODO()
+	if err := a.reconcile(ctx, nodes); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	cm, err := client.CoreV1().ConfigMaps("kube-system").Get(
+		ctx, defaultAllocations, meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(cm.Data, map[string]string{"vm-002": "0", "vm-003": "1"}) {
+		t.Errorf("Unexpected allocations %v", cm.Data)
+	}
+	n, err := client.CoreV1().Nodes().Get(ctx, "vm-003", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if v := n.ObjectMeta.Annotations[annotation]; v != "10.0.1.0/24" {
+		t.Errorf("Annotation %s, expected 10.0.1.0/24", v)
+	}
+
+	// A new allocator (leader) must read the stored allocations
+	a2 := a
+	a2.allocations = nil
+	a2.releaseGrace = time.Hour
+	if err := a2.reconcile(ctx, nodes[1:]); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(a2.allocations, map[string]uint{"vm-003": 1}) {
+		t.Errorf("Unexpected allocations %v", a2.allocations)
+	}
+
+	// The released number is stored, and is not reused by the next
+	// leader
+	a3 := a2
+	a3.allocations = nil
+	a3.released = nil
+	nodes = append(nodes[1:], k8s.Node{ObjectMeta: meta.ObjectMeta{Name: "vm-004"}})
+	if _, err := client.CoreV1().Nodes().Create(
+		ctx, nodes[1].DeepCopy(), meta.CreateOptions{}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := a3.reconcile(ctx, nodes); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(a3.allocations, map[string]uint{"vm-003": 1, "vm-004": 2}) {
+		t.Errorf("Unexpected allocations %v", a3.allocations)
+	}
+	if _, ok := a3.released[0]; !ok {
+		t.Errorf("Unexpected released %v", a3.released)
+	}
+}
+
+func TestCidrConflicts(t *testing.T) {
+	const (
+		cidrAnnotation    = "cidr.nordix.org/eth2"
+		addressAnnotation = "addr.nordix.org/eth2"
+	)
+	node := func(name string, created int64, cidrs string) k8s.Node {
+		return k8s.Node{
+			ObjectMeta: meta.ObjectMeta{
+				Name:              name,
+				CreationTimestamp: meta.Unix(created, 0),
+				Annotations: map[string]string{
+					cidrAnnotation:    cidrs,
+					addressAnnotation: "192.168.1.1,fd00:1::192.168.1.1",
+				},
+			},
+		}
+	}
+	tcases := []struct {
+		name      string
+		nodes     []k8s.Node
+		routes    []string
+		conflicts []cidrConflict
+	}{
+		{
+			name: "No conflicts",
+			nodes: []k8s.Node{node("vm-002", 0, "10.0.0.0/24,fd00::/112"),
+				node("vm-003", 0, "10.0.1.0/24,fd00::1:0/112")},
+			routes: []string{"10.0.0.0/24", "10.0.1.0/24", "fd00::/112", "fd00::1:0/112"},
+		},
+		{
+			name: "Duplicate, name order",
+			nodes: []k8s.Node{node("vm-003", 0, "10.0.0.0/24"),
+				node("vm-002", 0, "10.0.0.0/24")},
+			routes: []string{"10.0.0.0/24"},
+			conflicts: []cidrConflict{
+				{Node: "vm-003", Cidr: "10.0.0.0/24", Other: "vm-002", OtherCidr: "10.0.0.0/24"}},
+		},
+		{
+			name: "Contains, oldest node wins",
+			nodes: []k8s.Node{node("vm-002", 100, "10.0.0.0/16,fd00::/112"),
+				node("vm-003", 10, "10.0.1.0/24,fd00::1:0/112")},
+			routes: []string{"10.0.1.0/24", "fd00::/112", "fd00::1:0/112"},
+			conflicts: []cidrConflict{
+				{Node: "vm-002", Cidr: "10.0.0.0/16", Other: "vm-003", OtherCidr: "10.0.1.0/24"}},
+		},
+		{
+			name: "Own node wins",
+			nodes: []k8s.Node{node("vm-002", 0, "10.0.0.0/24"),
+				node("myself", 100, "10.0.0.128/25")},
+			conflicts: []cidrConflict{
+				{Node: "vm-002", Cidr: "10.0.0.0/24", Other: "myself", OtherCidr: "10.0.0.128/25"}},
+		},
+		{
+			name:   "Same node",
+			nodes:  []k8s.Node{node("vm-002", 0, "10.0.0.0/24,10.0.0.0/16")},
+			routes: []string{"10.0.0.0/16", "10.0.0.0/24"},
+		},
+	}
+	_ = os.Setenv("NODE_NAME", "myself")
+	for _, tc := range tcases {
+		sh := syncHandler{
+			cidrAnnotation:    cidrAnnotation,
+			addressAnnotation: addressAnnotation,
+			rh:                newTestRouteHandler(t, nil),
+		}
+		result, err := sh.syncRoutes(context.TODO(), tc.nodes)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error %v", tc.name, err)
+		}
+		routes, _ := sh.rh.GetRoutes(context.TODO())
+		dsts := make([]string, 0, len(routes))
+		for _, r := range routes {
+			dsts = append(dsts, r.Dst)
+		}
+		sort.Strings(dsts)
+		if len(dsts) != len(tc.routes) || (len(dsts) > 0 && !reflect.DeepEqual(dsts, tc.routes)) {
+			t.Errorf("%s: Routes %v, expected %v", tc.name, dsts, tc.routes)
+		}
+		if len(result.Conflicts) != len(tc.conflicts) ||
+			(len(tc.conflicts) > 0 && !reflect.DeepEqual(result.Conflicts, tc.conflicts)) {
+			t.Errorf("%s: Conflicts %v, expected %v", tc.name, result.Conflicts, tc.conflicts)
+		}
+	}
+}
+
+func TestNodeEvents(t *testing.T) {
+	const cidrAnnotation = "cidr.nordix.org/eth2"
+	node := func(name, cidrs, addresses string) k8s.Node {
+		n := k8s.Node{
+			ObjectMeta: meta.ObjectMeta{
+				Name:        name,
+				Annotations: map[string]string{cidrAnnotation: cidrs},
+			},
+		}
+		if addresses != "" {
+			n.Status.Addresses = []k8s.NodeAddress{{Type: "InternalIP", Address: addresses}}
+		}
+		return n
+	}
+	tcases := []struct {
+		name     string
+		nodes    []k8s.Node
+		expected []string
+	}{
+		{
+			name:     "No node addresses",
+			nodes:    []k8s.Node{node("myself", "10.0.0.0/24", "")},
+			expected: []string{"Warning NoNodeAddresses Network default: No node addresses"},
+		},
+		{
+			name:  "Repeated problem",
+			nodes: []k8s.Node{node("myself", "10.0.0.0/24", "")},
+		},
+		{
+			name: "Problems with own node only",
+			nodes: []k8s.Node{node("myself", "10.0.0.0/24,fd00::/112", "192.168.1.1"),
+				node("peer", "", "192.168.1.2")},
+			expected: []string{
+				"Warning NoGateway Network default: No Gateway for CIDR fd00::/112, no IPv6 node address"},
+		},
+		{
+			name: "Conflict",
+			nodes: []k8s.Node{node("myself", "10.0.0.0/24,x", "192.168.1.1"),
+				node("peer", "10.0.0.0/16", "192.168.1.2")},
+			expected: []string{
+				"Warning CIDRParseFailed Network default: Parse failed, CIDR x",
+				"Warning CIDRConflict Network default: CIDR 10.0.0.0/24 conflicts with 10.0.0.0/16 of node peer"},
+		},
+		{
+			name:     "Problem re-appears",
+			nodes:    []k8s.Node{node("myself", "10.0.0.0/24", "")},
+			expected: []string{"Warning NoNodeAddresses Network default: No node addresses"},
+		},
+	}
+	_ = os.Setenv("NODE_NAME", "myself")
+	recorder := record.NewFakeRecorder(10)
+	e := nodeEvents{recorder: recorder, node: "myself"}
+	for _, tc := range tcases {
+		sh := syncHandler{
+			cidrAnnotation: cidrAnnotation,
+			rh:             newTestRouteHandler(t, nil),
+		}
+		result, err := sh.syncRoutes(context.TODO(), tc.nodes)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error %v", tc.name, err)
+		}
+		e.report(context.TODO(), "default", result, nil)
+		var events []string
+		for len(recorder.Events) > 0 {
+			events = append(events, <-recorder.Events)
+		}
+		if len(events) != len(tc.expected) ||
+			(len(events) > 0 && !reflect.DeepEqual(events, tc.expected)) {
+			t.Errorf("%s: Events %q, expected %q", tc.name, events, tc.expected)
+		}
+	}
+}
+
+func TestNodeCondition(t *testing.T) {
+	node := k8s.Node{
+		ObjectMeta: meta.ObjectMeta{Name: "myself"},
+		Status: k8s.NodeStatus{
+			Conditions: []k8s.NodeCondition{
+				{Type: k8s.NodeReady, Status: k8s.ConditionTrue},
+			},
+		},
+	}
+	tcases := []struct {
+		name    string
+		network string
+		result  *syncResult
+		err     error
+		status  k8s.ConditionStatus
+		reason  string
+		message string
+	}{
+		{
+			name:    "Sync failed",
+			network: "default",
+			err:     fmt.Errorf("No routes"),
+			status:  k8s.ConditionFalse,
+			reason:  "SyncFailed",
+			message: "No routes, no successful sync",
+		},
+		{
+			name:    "Synced",
+			network: "default",
+			result:  &syncResult{Routes: 4},
+			status:  k8s.ConditionTrue,
+			reason:  "RoutesSynced",
+			message: "4 routes, 0 failures, last successful sync",
+		},
+		{
+			name:    "Failures",
+			network: "default",
+			result:  &syncResult{Routes: 4, Failures: []syncFailure{{Op: "set"}}},
+			status:  k8s.ConditionFalse,
+			reason:  "RouteFailures",
+			message: "4 routes, 1 failures, last successful sync",
+		},
+		{
+			name:    "Other network",
+			network: "net3",
+			result:  &syncResult{Routes: 2},
+			status:  k8s.ConditionTrue,
+			reason:  "RoutesSynced",
+			message: "2 routes, 0 failures, last successful sync",
+		},
+	}
+	client := fake.NewSimpleClientset(node.DeepCopy())
+	c := nodeCondition{client: client, node: "myself"}
+	ctx := context.TODO()
+	for _, tc := range tcases {
+		c.report(ctx, tc.network, tc.result, tc.err)
+		n, err := client.CoreV1().Nodes().Get(ctx, "myself", meta.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: Unexpected error %v", tc.name, err)
+		}
+		var cond, ready *k8s.NodeCondition
+		for i := range n.Status.Conditions {
+			switch n.Status.Conditions[i].Type {
+			case networkConditionType(tc.network):
+				cond = &n.Status.Conditions[i]
+			case k8s.NodeReady:
+				ready = &n.Status.Conditions[i]
+			}
+		}
+		if cond == nil {
+			t.Fatalf("%s: Condition not found %v", tc.name, n.Status.Conditions)
+		}
+		if cond.Status != tc.status || cond.Reason != tc.reason ||
+			!strings.HasPrefix(cond.Message, tc.message) {
+			t.Errorf("%s: Unexpected condition %+v", tc.name, cond)
+		}
+		if ready == nil || ready.Status != k8s.ConditionTrue {
+			t.Errorf("%s: Other conditions affected %v", tc.name, n.Status.Conditions)
+		}
+	}
+
+	// The condition of a removed network is removed
+	c.remove(ctx, "net3")
+	n, err := client.CoreV1().Nodes().Get(ctx, "myself", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	types := []string{}
+	for _, cond := range n.Status.Conditions {
+		types = append(types, string(cond.Type))
+	}
+	sort.Strings(types)
+	expected := []string{string(k8s.NodeReady), conditionType}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("Unexpected conditions after remove %v", types)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	const cidrAnnotation = "cidr.nordix.org/eth2"
+	h := &testNodeHandler{
+		nodes: []k8s.Node{
+			{
+				ObjectMeta: meta.ObjectMeta{
+					Name:        "peer",
+					Annotations: map[string]string{cidrAnnotation: "10.0.0.0/24"},
+				},
+				Status: k8s.NodeStatus{Addresses: []k8s.NodeAddress{
+					{Type: "InternalIP", Address: "192.168.1.2"}}},
+			},
+			{
+				ObjectMeta: meta.ObjectMeta{
+					Name:        "vm-003",
+					Annotations: map[string]string{cidrAnnotation: "10.0.1.0/24"},
+				},
+			},
+		},
+	}
+	_ = os.Setenv("NODE_NAME", "myself")
+	s := &syncer{
+		h: h,
+		sh: &syncHandler{
+			protocol:       "202",
+			cidrAnnotation: cidrAnnotation,
+			rh:             newTestRouteHandler(t, nil),
+		},
+		ch:      make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		network: "admin-test",
+	}
+	nw := networks{h: h}
+	if err := nw.ready(); err == nil {
+		t.Errorf("Ready without networks")
+	}
+	nw.wanted = []string{"admin-test", "failed"}
+	nw.failed = map[string]error{"failed": fmt.Errorf("No VRF")}
+	if err := nw.ready(); err == nil {
+		t.Errorf("Ready with a failed network")
+	}
+	nw.wanted = []string{"admin-test"}
+	nw.failed = nil
+	if err := nw.ready(); err == nil {
+		t.Errorf("Ready with a network not started")
+	}
+	nw.items = map[string]*network{
+		"admin-test": {config: networkConfig{Name: "admin-test"}, syncer: s}}
+	if err := nw.health(); err == nil {
+		t.Errorf("Health OK before informer sync")
+	}
+	h.synced = true
+	if err := nw.health(); err != nil {
+		t.Errorf("Unexpected health error %v", err)
+	}
+	if err := nw.ready(); err == nil {
+		t.Errorf("Ready before sync")
+	}
+
+	ctx := context.TODO()
+	s.sync(ctx)
+	if err := nw.ready(); err != nil {
+		t.Errorf("Unexpected ready error %v", err)
+	}
+	states := nw.state(ctx)
+	if len(states) != 1 || states[0].LastSync == nil ||
+		len(states[0].Wanted) != 1 || len(states[0].Kernel) != 1 ||
+		len(states[0].Problems) != 1 ||
+		states[0].Problems[0].Reason != reasonNoNodeAddresses {
+		t.Errorf("Unexpected state %+v", states)
+	}
+	if v := testutil.ToFloat64(managedRoutes.WithLabelValues("admin-test", "202")); v != 1 {
+		t.Errorf("Managed routes %v, expected 1", v)
+	}
+	if v := testutil.ToFloat64(routeOperations.WithLabelValues("202", "add")); v != 1 {
+		t.Errorf("Added routes %v, expected 1", v)
+	}
+	if v := testutil.ToFloat64(skippedNodes.WithLabelValues("admin-test", reasonNoNodeAddresses)); v != 1 {
+		t.Errorf("Skipped nodes %v, expected 1", v)
+	}
+	s.trig(ctx)
+	s.trig(ctx)
+	if v := testutil.ToFloat64(syncTrigs.WithLabelValues("admin-test", "coalesced")); v != 1 {
+		t.Errorf("Coalesced trigs %v, expected 1", v)
+	}
+
+	close(s.done)
+	if err := nw.health(); err == nil {
+		t.Errorf("Health OK with a terminated syncer")
+	}
+	forgetMetrics("admin-test")
+}
+
+func TestSimulate(t *testing.T) {
+	const nodeList = `{
+  "kind": "NodeList",
+  "items": [
+    {
+      "metadata": {
+        "name": "vm-002",
+        "annotations": {"cidr.nordix.org/eth2": "10.0.0.0/24,fd00::/112"}
+      },
+      "status": {"addresses": [{"type": "InternalIP", "address": "192.168.1.2"}]}
+    },
+    {
+      "metadata": {
+        "name": "vm-003",
+        "annotations": {"cidr.nordix.org/eth2": "10.0.1.0/24"}
+      }
+    }
+  ]
+}`
+	const yamlNodes = `
+- metadata:
+    name: vm-002
+    annotations:
+      cidr.nordix.org/eth2: 10.0.0.0/24,fd00::/112
+  status:
+    addresses:
+      - type: InternalIP
+        address: 192.168.1.2
+- metadata:
+    name: vm-003
+    annotations:
+      cidr.nordix.org/eth2: 10.0.1.0/24
+`
+	n := networkConfig{
+		Name:           "default",
+		Protocol:       "202",
+		CidrAnnotation: "cidr.nordix.org/eth2",
+	}
+	expected := simulation{
+		Network:  "default",
+		Node:     "vm-003",
+		Selected: true,
+		Nodes:    1,
+		Routes: []util.Route{
+			{Dst: "10.0.0.0/24", Gateway: "192.168.1.2", Protocol: "202", Node: "vm-002"},
+		},
+		Problems: []nodeProblem{
+			{Node: "vm-002", Reason: reasonNoGateway,
+				Message: "No Gateway for CIDR fd00::/112, no IPv6 node address"},
+			{Node: "vm-003", Reason: reasonNoNodeAddresses, Message: "No node addresses"},
+		},
+	}
+	for _, input := range []string{nodeList, yamlNodes} {
+		nodes, err := parseNodes([]byte(input))
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		sim, err := simulate(context.TODO(), &n, nodes, "vm-003")
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(*sim, expected) {
+			t.Errorf("Unexpected simulation %+v", *sim)
+		}
+	}
+	if _, err := parseNodes([]byte("kind: Pod\nspec: 1")); err == nil {
+		t.Errorf("Expected error for invalid input")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	n := networkConfig{
+		Name:           "net3",
+		Protocol:       "202",
+		CidrAnnotation: testCidrAnnotation,
+		AllocateCidrs:  []string{"10.0.0.0/16/24", "fd00::/96/112"},
+	}
+	nodes := []k8s.Node{
+		testNode("vm-001", "10.0.1.0/24,fd00::1:0/112", "192.168.1.1", "fd00:1::1"),
+		testNode("vm-002", "10.0.2.0/24,fd00::2:0/112", "192.168.1.2"),
+		testNode("vm-003", "10.0.1.0/24", "192.168.1.3", "1000::x"),
+		testNode("vm-004", "10.1.0.0/24,bad", "192.168.1.4"),
+		testNode("vm-005", "", "192.168.1.5"),
+	}
+	nodes[2].ObjectMeta.CreationTimestamp = meta.Unix(10, 0)
+	expected := []auditFinding{
+		{"net3", "vm-002", reasonNoGateway, "No Gateway for CIDR fd00::2:0/112, no IPv6 node address"},
+		{"net3", "vm-003", reasonAddressParseFailed, "Parse failed, address 1000::x"},
+		{"net3", "vm-003", reasonCidrConflict, "CIDR 10.0.1.0/24 conflicts with 10.0.1.0/24 of node vm-001"},
+		{"net3", "vm-004", reasonParseFailed, "Parse failed, CIDR bad"},
+		{"net3", "vm-004", reasonOutsideSupernet, "CIDR 10.1.0.0/24 is not a node CIDR in 10.0.0.0/16/24,fd00::/96/112"},
+		{"net3", "vm-005", reasonNoPodCidrs, "No POD CIDRs"},
+	}
+	findings, err := audit(context.TODO(), &n, nodes)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Errorf("Unexpected findings;\n%v\nexpected;\n%v", findings, expected)
+	}
+
+	// An empty address annotation is the same as a missing one
+	n.AddressAnnotation = "adr.nordix.org/eth2"
+	node := testNode("vm-006", "10.0.6.0/24")
+	node.ObjectMeta.Annotations[n.AddressAnnotation] = ""
+	if findings, err = audit(context.TODO(), &n, []k8s.Node{node}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected = []auditFinding{
+		{"net3", "vm-006", reasonNoNodeAddresses, "No node addresses"}}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Errorf("Unexpected findings %v", findings)
+	}
+}
+
+func TestInSupernet(t *testing.T) {
+	tcases := []struct {
+		supernets []string
+		cidr      string
+		expected  bool
+	}{
+		{[]string{"10.0.0.0/16/24"}, "10.0.3.0/24", true},
+		{[]string{"10.0.0.0/16/24"}, "10.0.3.0/25", false},
+		{[]string{"10.0.0.0/16/24"}, "10.1.3.0/24", false},
+		{[]string{"10.0.0.0/16/24"}, "fd00::/112", true},
+		{[]string{"10.0.0.0/16/24", "fd00::/96/112"}, "fd00::/112", true},
+		{[]string{"10.0.0.0/16/24", "fd00::/96/112"}, "fd01::/112", false},
+		{[]string{"10.0.0.0/16/24", "10.1.0.0/16/24"}, "10.1.3.0/24", true},
+	}
+	for _, tc := range tcases {
+		if r := inSupernet(tc.supernets, tc.cidr); r != tc.expected {
+			t.Errorf("inSupernet(%v, %s) = %v", tc.supernets, tc.cidr, r)
+		}
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	dir := t.TempDir()
+	cniDir := filepath.Join(dir, "net.d")
+	cniBin := filepath.Join(dir, "bin")
+	procSys := filepath.Join(dir, "sys")
+	write := func(file, content string, mode os.FileMode) {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(cniDir, "10-xcluster-cni.conf"), `{
+  "name": "xcluster", "type": "bridge", "mtu": 1500,
+  "ipam": {"type": "kube-node"}
+}`, 0644)
+	write(filepath.Join(cniDir, "20-other.conflist"), "{", 0644)
+	write(filepath.Join(cniBin, "bridge"), "", 0755)
+	write(filepath.Join(cniBin, "kube-node"), "", 0644)
+	write(filepath.Join(procSys, "net/ipv4/ip_forward"), "1\n", 0644)
+	write(filepath.Join(procSys, "net/ipv6/conf/all/forwarding"), "0\n", 0644)
+	write(filepath.Join(procSys, "net/ipv4/conf/all/rp_filter"), "0\n", 0644)
+	write(filepath.Join(procSys, "net/ipv4/conf/eth1/rp_filter"), "1\n", 0644)
+
+	nodes := []k8s.Node{
+		testNode("vm-002", "10.0.2.0/24,fd00::2:0/112", "192.168.1.2", "fd00:1::2"),
+		testNode("vm-003", "10.0.3.0/24,fd00::3:0/112", "192.168.1.3", "fd00:1::3"),
+		testNode("vm-004", "10.0.4.0/24", "172.16.0.4"),
+	}
+	rh := newTestRouteHandler(t, []util.Route{
+		{Dst: "10.0.3.0/24", Gateway: "192.168.1.3", Protocol: "202"},
+		{Dst: "10.0.5.0/24", Gateway: "192.168.1.5", Protocol: "202"},
+	})
+	eth1 := net.Interface{Name: "eth1", MTU: 1400}
+	d := doctor{
+		cniDir:   cniDir,
+		cniBin:   cniBin,
+		procSys:  procSys,
+		plugins:  []string{"bridge", "host-local"},
+		node:     &nodes[0],
+		nodes:    nodes,
+		networks: []networkConfig{{Name: "default", Protocol: "202", CidrAnnotation: testCidrAnnotation}},
+		syncHandler: func(ctx context.Context, n *networkConfig) (*syncHandler, error) {
+			sh, err := newOfflineSyncHandler(n)
+			if err != nil {
+				return nil, err
+			}
+			sh.rh = rh
+			return sh, nil
+		},
+		localInterface: func(ip string) (*net.Interface, error) {
+			if strings.HasPrefix(ip, "192.168.1.") || strings.HasPrefix(ip, "fd00:1::") {
+				return &eth1, nil
+			}
+			return nil, fmt.Errorf("No interface found for %s", ip)
+		},
+	}
+	checks := d.run(context.TODO())
+	result := make(map[string]string)
+	for _, c := range checks {
+		r := "PASS"
+		if !c.Pass {
+			r = "FAIL"
+			if c.Hint == "" {
+				t.Errorf("No hint for %s", c.Name)
+			}
+		}
+		result[c.Name] += r + " " + c.Message + "; "
+	}
+	expected := map[string]string{
+		"cni-config": "PASS " + filepath.Join(cniDir, "10-xcluster-cni.conf") + ", name xcluster; ",
+		"cni-mtu":    "FAIL MTU 1500 in the config, eth1 has MTU 1400; ",
+		"plugins":    "FAIL Missing in " + cniBin + ": kube-node,host-local; ",
+		"forwarding": "PASS net.ipv4.ip_forward is 1; FAIL net.ipv6.conf.all.forwarding is 0; ",
+		"rp-filter":  "FAIL Strict rp_filter on eth1; ",
+		"routes":     "FAIL missing 10.0.4.0/24, missing fd00::3:0/112, superfluous 10.0.5.0/24; ",
+		"gateways":   "FAIL Not on a local subnet: 172.16.0.4 (node vm-004); ",
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected checks;\n%v", result)
+	}
+
+	// Fix the problems
+	eth1.MTU = 1500
+	if err := os.Chmod(filepath.Join(cniBin, "kube-node"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(cniBin, "host-local"), "", 0755)
+	write(filepath.Join(procSys, "net/ipv6/conf/all/forwarding"), "1\n", 0644)
+	write(filepath.Join(procSys, "net/ipv4/conf/eth1/rp_filter"), "2\n", 0644)
+	nodes[2] = testNode("vm-004", "10.0.4.0/24", "192.168.1.4")
+	for _, c := range d.run(context.TODO()) {
+		if c.Name == "routes" {
+			continue // Not synced
+		}
+		if !c.Pass {
+			t.Errorf("Unexpected failure %+v", c)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	nodes := []k8s.Node{
+		testNode("vm-001", "10.0.1.0/24,fd00::1:0/112", "192.168.1.1", "fd00:1::1"),
+		testNode("vm-002", "10.0.2.0/24,fd00::2:0/112", "192.168.1.2"),
+		testNode("vm-003", "10.0.3.0/24"),
+		testNode("vm-004", "10.0.4.0/24", "192.168.1.4"),
+		testNode("vm-005", "10.0.2.128/25", "192.168.1.5"),
+	}
+	n := networkConfig{Name: "default", Protocol: "202", CidrAnnotation: testCidrAnnotation}
+	tcases := []struct {
+		name      string
+		src, dst  string
+		hops      []traceHop
+		back      []traceHop
+		symmetric bool
+		problems  []string
+	}{
+		{
+			name: "Symmetric",
+			src:  "10.0.1.5",
+			dst:  "10.0.2.7",
+			hops: []traceHop{
+				{Node: "vm-001", Route: "10.0.2.0/24", Gateways: []string{"192.168.1.2"},
+					Interface: "eth1", Next: "vm-002"},
+				{Node: "vm-002", Route: "10.0.2.0/24"},
+			},
+			back: []traceHop{
+				{Node: "vm-002", Route: "10.0.1.0/24", Gateways: []string{"192.168.1.1"},
+					Next: "vm-001"},
+				{Node: "vm-001", Route: "10.0.1.0/24"},
+			},
+			symmetric: true,
+		},
+		{
+			name:      "Same node",
+			src:       "10.0.1.5",
+			dst:       "10.0.1.7",
+			hops:      []traceHop{{Node: "vm-001", Route: "10.0.1.0/24"}},
+			back:      []traceHop{{Node: "vm-001", Route: "10.0.1.0/24"}},
+			symmetric: true,
+		},
+		{
+			name: "No IPv6 gateway",
+			src:  "fd00::1:5",
+			dst:  "fd00::2:7",
+			hops: []traceHop{},
+			back: []traceHop{
+				{Node: "vm-002", Route: "fd00::1:0/112", Gateways: []string{"fd00:1::1"},
+					Next: "vm-001"},
+				{Node: "vm-001", Route: "fd00::1:0/112"},
+			},
+			problems: []string{
+				"No route to fd00::2:7 on node vm-001",
+				"Node vm-002: No Gateway for CIDR fd00::2:0/112, no IPv6 node address",
+			},
+		},
+		{
+			name: "Unknown source",
+			src:  "10.0.9.1",
+			dst:  "10.0.4.1",
+			hops: []traceHop{},
+			back: []traceHop{},
+			problems: []string{
+				"No node owns 10.0.9.1",
+				"No route to 10.0.9.1 on node vm-004",
+			},
+		},
+		{
+			name: "Gateway not local",
+			src:  "10.0.1.5",
+			dst:  "10.0.4.1",
+			hops: []traceHop{
+				{Node: "vm-001", Route: "10.0.4.0/24", Gateways: []string{"192.168.1.4"},
+					Next: "vm-004"},
+				{Node: "vm-004", Route: "10.0.4.0/24"},
+			},
+			back: []traceHop{
+				{Node: "vm-004", Route: "10.0.1.0/24", Gateways: []string{"192.168.1.1"},
+					Next: "vm-001"},
+				{Node: "vm-001", Route: "10.0.1.0/24"},
+			},
+			symmetric: true,
+			problems:  []string{"Gateway 192.168.1.4 is not on a local subnet"},
+		},
+		{
+			name: "CIDR conflict",
+			src:  "10.0.1.5",
+			dst:  "10.0.2.200",
+			hops: []traceHop{
+				{Node: "vm-001", Route: "10.0.2.0/24", Gateways: []string{"192.168.1.2"},
+					Interface: "eth1", Next: "vm-002"},
+				{Node: "vm-002", Route: "10.0.2.0/24"},
+			},
+			back: []traceHop{
+				{Node: "vm-002", Route: "10.0.1.0/24", Gateways: []string{"192.168.1.1"},
+					Next: "vm-001"},
+				{Node: "vm-001", Route: "10.0.1.0/24"},
+			},
+			symmetric: true,
+			problems: []string{
+				"Node vm-005: CIDR 10.0.2.128/25 conflicts with 10.0.2.0/24 of node vm-002",
+			},
+		},
+	}
+	for _, tc := range tcases {
+		tr := tracer{
+			myself: "vm-001",
+			localInterface: func(ip string) (*net.Interface, error) {
+				if ip == "192.168.1.2" {
+					return &net.Interface{Name: "eth1"}, nil
+				}
+				return nil, fmt.Errorf("No interface found for %s", ip)
+			},
+		}
+		res, err := tr.trace(context.TODO(), &n, nodes, net.ParseIP(tc.src), net.ParseIP(tc.dst))
+		if err != nil {
+			t.Fatalf("%s: Unexpected error %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(res.Hops, tc.hops) {
+			t.Errorf("%s: Unexpected hops %+v", tc.name, res.Hops)
+		}
+		if !reflect.DeepEqual(res.Return, tc.back) {
+			t.Errorf("%s: Unexpected return %+v", tc.name, res.Return)
+		}
+		if res.Symmetric != tc.symmetric {
+			t.Errorf("%s: Unexpected symmetric %v", tc.name, res.Symmetric)
+		}
+		if !reflect.DeepEqual(res.Problems, tc.problems) {
+			t.Errorf("%s: Unexpected problems %q", tc.name, res.Problems)
+		}
+	}
+}
+
+func TestTopology(t *testing.T) {
+	nodes := []k8s.Node{
+		testNode("vm-002", "10.0.2.0/24,fd00::2:0/112", "192.168.1.2"),
+		testNode("vm-001", "10.0.1.0/24,fd00::1:0/112", "192.168.1.1", "fd00:1::1"),
+		testNode("vm-003", "10.0.3.0/24"),
+		{ObjectMeta: meta.ObjectMeta{Name: "vm-004"}},
+	}
+	for i := range nodes[:3] {
+		nodes[i].ObjectMeta.Labels = map[string]string{"net3": "yes"}
+	}
+	n := networkConfig{
+		Name:           "net3",
+		Protocol:       "202",
+		CidrAnnotation: testCidrAnnotation,
+		NodeSelector:   &meta.LabelSelector{MatchLabels: map[string]string{"net3": "yes"}},
+	}
+	topo, err := buildTopology(context.TODO(), &n, nodes)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := topology{
+		Network: "net3",
+		Nodes: []topologyNode{
+			{Name: "vm-001", Cidrs: []string{"10.0.1.0/24", "fd00::1:0/112"}},
+			{Name: "vm-002", Cidrs: []string{"10.0.2.0/24", "fd00::2:0/112"},
+				Problems: []string{"No Gateway for CIDR fd00::2:0/112, no IPv6 node address"}},
+			{Name: "vm-003", Cidrs: []string{"10.0.3.0/24"}, Skipped: true,
+				Problems: []string{"No node addresses"}},
+		},
+		Edges: []topologyEdge{
+			{From: "vm-001", To: "vm-002", Family: 4, Gateways: []string{"192.168.1.2"}},
+			{From: "vm-002", To: "vm-001", Family: 4, Gateways: []string{"192.168.1.1"}},
+			{From: "vm-002", To: "vm-001", Family: 6, Gateways: []string{"fd00:1::1"}},
+			{From: "vm-003", To: "vm-001", Family: 4, Gateways: []string{"192.168.1.1"}},
+			{From: "vm-003", To: "vm-001", Family: 6, Gateways: []string{"fd00:1::1"}},
+			{From: "vm-003", To: "vm-002", Family: 4, Gateways: []string{"192.168.1.2"}},
+		},
+	}
+	if !reflect.DeepEqual(*topo, expected) {
+		t.Errorf("Unexpected topology;\n%+v", *topo)
+	}
+
+	var dot strings.Builder
+	printDot(&dot, []*topology{topo})
+	for _, line := range []string{
+		`"net3/vm-003" [label="vm-003\n10.0.3.0/24", color=red, style=dashed, tooltip="No node addresses"];`,
+		`"net3/vm-002" -> "net3/vm-001" [label="fd00:1::1", color=darkgreen];`,
+	} {
+		if !strings.Contains(dot.String(), line) {
+			t.Errorf("Missing in DOT output: %s\n%s", line, dot.String())
+		}
+	}
+	var mermaid strings.Builder
+	printMermaid(&mermaid, []*topology{topo})
+	for _, line := range []string{
+		`class n0_1 partial`,
+		`n0_0 -->|"192.168.1.2"| n0_1`,
+		`linkStyle 2,4 stroke:darkgreen`,
+	} {
+		if !strings.Contains(mermaid.String(), line) {
+			t.Errorf("Missing in Mermaid output: %s\n%s", line, mermaid.String())
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served on "/metrics" by the admin server
+var (
+	syncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "xcluster_cni",
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of route syncs",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"network"})
+	syncTrigs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "xcluster_cni",
+		Name:      "sync_trigs_total",
+		Help:      "Sync trigs. Result is triggered, or coalesced with a pending sync",
+	}, []string{"network", "result"})
+	routeOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "xcluster_cni",
+		Name:      "route_operations_total",
+		Help:      "Route operations. Op is add, replace or delete",
+	}, []string{"protocol", "op"})
+	routeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "xcluster_cni",
+		Name:      "route_errors_total",
+		Help:      "Failed route and rule operations, and failed syncs (op=sync)",
+	}, []string{"protocol", "op"})
+	managedRoutes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "xcluster_cni",
+		Name:      "managed_routes",
+		Help:      "The number of wanted routes after the last sync",
+	}, []string{"network", "protocol"})
+	skippedNodes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "xcluster_cni",
+		Name:      "skipped_nodes",
+		Help:      "Nodes that are not, or only partly, routed per reason in the last sync",
+	}, []string{"network", "reason"})
+	informerLastEvent = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "xcluster_cni",
+		Name:      "informer_last_event_timestamp_seconds",
+		Help:      "The time of the last event from the node informer",
+	})
+)
+
+// problemReasons All reasons for node problems
+var problemReasons = []string{
+	reasonNoNodeAddresses, reasonNoPodCidrs, reasonParseFailed,
+	reasonNoGateway, reasonCidrConflict, reasonAddressParseFailed,
+}
+
+// recordSync Update metrics after a sync
+func recordSync(
+	network, protocol string, d time.Duration, result *syncResult, err error) {
+	syncDuration.WithLabelValues(network).Observe(d.Seconds())
+	if err != nil {
+		routeErrors.WithLabelValues(protocol, "sync").Inc()
+		return
+	}
+	routeOperations.WithLabelValues(protocol, "add").Add(float64(result.Added))
+	routeOperations.WithLabelValues(protocol, "replace").Add(float64(result.Replaced))
+	routeOperations.WithLabelValues(protocol, "delete").Add(float64(result.Deleted))
+	for _, f := range result.Failures {
+		routeErrors.WithLabelValues(protocol, f.Op).Inc()
+	}
+	managedRoutes.WithLabelValues(network, protocol).Set(float64(result.Routes))
+	skipped := make(map[string]map[string]bool)
+	for _, p := range result.Problems {
+		if skipped[p.Reason] == nil {
+			skipped[p.Reason] = make(map[string]bool)
+		}
+		skipped[p.Reason][p.Node] = true
+	}
+	for _, reason := range problemReasons {
+		skippedNodes.WithLabelValues(network, reason).Set(float64(len(skipped[reason])))
+	}
+}
+
+// forgetMetrics Remove the metrics of a stopped network
+func forgetMetrics(network string) {
+	labels := prometheus.Labels{"network": network}
+	syncDuration.DeletePartialMatch(labels)
+	syncTrigs.DeletePartialMatch(labels)
+	managedRoutes.DeletePartialMatch(labels)
+	skippedNodes.DeletePartialMatch(labels)
+}
@@ -0,0 +1,275 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	"github.com/go-logr/logr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// network A running network with its own syncer. The context is
+// cancelled when the network is stopped
+type network struct {
+	config networkConfig
+	syncer *syncer
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// networks The running networks. One node informer (h) feeds the
+// syncers of all networks. Networks are added, changed or removed
+// when the config is applied
+type networks struct {
+	mu     sync.Mutex
+	h      util.Handler
+	dryRun string
+	items  map[string]*network
+	// wanted The names of the networks in the applied config
+	wanted []string
+	// failed Networks in the config that failed to start. They are
+	// started when the config is applied again
+	failed map[string]error
+	// applyMu Serializes apply, so "mu" isn't held while networks are
+	// stopped, which may take seconds
+	applyMu sync.Mutex
+	// reporters Are passed to the syncers
+	reporters []syncReporter
+	// removers Are called when a network is removed from the config
+	removers []func(ctx context.Context, network string)
+	// clientset Is used to publish addresses
+	clientset kubernetes.Interface
+}
+
+// configPollInterval How often the config file is checked for updates.
+// Polling is used since a ConfigMap is updated by replacing symlinks
+const configPollInterval = time.Second * 10
+
+// trig Trig a sync of all networks. Called on any K8s node update
+func (nw *networks) trig() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	for _, n := range nw.items {
+		n.syncer.trig(n.ctx)
+	}
+}
+
+// apply Start, restart or stop networks to match the config. Routes
+// of removed networks are deleted. Errors for individual networks are
+// logged, and the first error is returned. Networks that failed to
+// start are kept in "failed"
+func (nw *networks) apply(ctx context.Context, cfg *daemonConfig) error {
+	nw.applyMu.Lock()
+	defer nw.applyMu.Unlock()
+	logger := logr.FromContextOrDiscard(ctx)
+	wanted := make(map[string]*networkConfig, len(cfg.Networks))
+	for i := range cfg.Networks {
+		wanted[cfg.Networks[i].Name] = &cfg.Networks[i]
+	}
+	type stopped struct {
+		n       *network
+		cleanup bool
+		removed bool
+	}
+	var stop []stopped
+	nw.mu.Lock()
+	nw.wanted = nw.wanted[:0]
+	for name := range wanted {
+		nw.wanted = append(nw.wanted, name)
+	}
+	for name, n := range nw.items {
+		c, ok := wanted[name]
+		if ok && reflect.DeepEqual(*c, n.config) {
+			continue
+		}
+		// Routes are left if they will be handled in the same way
+		cleanup := !ok || !sameRoutes(c, &n.config)
+		stop = append(stop, stopped{n: n, cleanup: cleanup, removed: !ok})
+		delete(nw.items, name)
+	}
+	nw.mu.Unlock()
+
+	// Stopping waits for an ongoing sync and a cleanup, so it's done
+	// without holding the lock
+	for _, s := range stop {
+		logger.Info("Stop network", "name", s.n.config.Name, "cleanup", s.cleanup)
+		nw.stop(s.n, s.cleanup)
+		// After the stop, since an ongoing sync updates the metrics
+		forgetMetrics(s.n.config.Name)
+		if s.removed {
+			for _, remove := range nw.removers {
+				remove(ctx, s.n.config.Name)
+			}
+		}
+	}
+
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.failed = make(map[string]error)
+	var firstErr error
+	for name, c := range wanted {
+		if _, ok := nw.items[name]; ok {
+			continue
+		}
+		logger.Info("Start network", "config", c)
+		n, err := nw.start(ctx, c)
+		if err != nil {
+			logger.Error(err, "Start network", "name", name)
+			nw.failed[name] = err
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		nw.items[name] = n
+	}
+	return firstErr
+}
+
+// sameRoutes Returns true if the routes and rules of the networks are
+// handled in the same way
+func sameRoutes(c1, c2 *networkConfig) bool {
+	return c1.Protocol == c2.Protocol && c1.Table == c2.Table &&
+		c1.RouteHandler == c2.RouteHandler && c1.Vrf == c2.Vrf &&
+		c1.RulePriority == c2.RulePriority
+}
+
+// start Start a syncer and a netlink monitor for a network
+func (nw *networks) start(
+	ctx context.Context, c *networkConfig) (*network, error) {
+	logger := logr.FromContextOrDiscard(ctx).WithValues("network", c.Name)
+	ctx = logr.NewContext(ctx, logger)
+	sh, err := newSyncHandler(ctx, c, nw.dryRun != "")
+	if err != nil {
+		return nil, err
+	}
+	n := network{
+		config: *c,
+		syncer: &syncer{
+			h:  nw.h,
+			sh: sh,
+			// The capacity is just one to make sure the channel is
+			// drained on each sync. Non-blocking sending is used
+			ch:        make(chan struct{}, 1),
+			done:      make(chan struct{}),
+			dryRun:    nw.dryRun,
+			network:   c.Name,
+			reporters: nw.reporters,
+		},
+	}
+	if c.publishAddresses() {
+		n.syncer.publisher = &addressPublisher{
+			client:     nw.clientset,
+			annotation: c.AddressAnnotation,
+			iface:      c.AddressInterface,
+			subnets:    c.AddressSubnets,
+			dryRun:     nw.dryRun != "",
+		}
+	}
+	n.ctx, n.cancel = context.WithCancel(ctx)
+	go n.syncer.run(n.ctx) // Start the syncing go function
+
+	// Restore routes that are removed, e.g. by "ip route del" or when
+	// a link goes down, without waiting for a K8s node update
+	err = util.MonitorNetlink(n.ctx, c.Protocol, c.Table, func() {
+		n.syncer.trig(n.ctx)
+	})
+	if err != nil {
+		n.cancel()
+		<-n.syncer.done
+		return nil, err
+	}
+	n.syncer.trig(n.ctx)
+	return &n, nil
+}
+
+// stop Stop the syncer of a network and wait until an ongoing sync is
+// done. If "cleanup" is set the routes and rules are removed
+func (nw *networks) stop(n *network, cleanup bool) {
+	n.cancel()
+	<-n.syncer.done
+	if n.syncer.retry != nil {
+		n.syncer.retry.Stop()
+	}
+	if !cleanup {
+		return
+	}
+	ctx, cancel := stopContext(n)
+	defer cancel()
+	if err := n.syncer.sh.cleanup(ctx); err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "Cleanup network")
+	}
+}
+
+// stopContext Returns a context for cleanup when a network is
+// stopped. The network context is cancelled, so a new one is needed
+func stopContext(n *network) (context.Context, context.CancelFunc) {
+	logger := logr.FromContextOrDiscard(n.ctx)
+	return context.WithTimeout(
+		logr.NewContext(context.Background(), logger), time.Second*5)
+}
+
+// shutdown Stop all networks and remove the policy routing rules.
+// Routes are kept so POD traffic is not disturbed on restarts
+func (nw *networks) shutdown() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	for name, n := range nw.items {
+		nw.stop(n, false)
+		ctx, cancel := stopContext(n)
+		if err := n.syncer.sh.deleteRules(ctx); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "Delete rules")
+		}
+		cancel()
+		delete(nw.items, name)
+	}
+}
+
+// watchConfig Poll the config file and apply it when it is updated.
+// An invalid config is logged and ignored. If some networks failed to
+// start, the config is applied again on the next poll
+func (nw *networks) watchConfig(ctx context.Context, file string) {
+	logger := logr.FromContextOrDiscard(ctx)
+	last, _ := os.ReadFile(file)
+	var retry *daemonConfig
+	for {
+		select {
+		case <-time.After(configPollInterval):
+		case <-ctx.Done():
+			return
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			logger.Error(err, "Read config", "file", file)
+			continue
+		}
+		cfg := retry
+		if !bytes.Equal(data, last) {
+			last = data
+			if c, err := parseConfig(data); err != nil {
+				logger.Error(err, "Invalid config, ignored", "file", file)
+			} else {
+				logger.Info("Config updated", "file", file)
+				cfg = c
+			}
+		}
+		if cfg == nil {
+			continue
+		}
+		retry = nil
+		if err := nw.apply(ctx, cfg); err != nil {
+			logger.Error(err, "Apply config, retried on next poll")
+			retry = cfg
+		}
+	}
+}
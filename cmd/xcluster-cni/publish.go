@@ -0,0 +1,85 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// addressPublisher Writes the addresses of a local interface, or
+// within subnets, to the address annotation of the own node. This
+// replaces manual "kubectl annotate" for secondary networks.
+type addressPublisher struct {
+	client     kubernetes.Interface
+	annotation string
+	iface      string
+	subnets    []string
+	dryRun     bool
+	// localAddresses may be set in unit-test. Default is
+	// util.GetInterfaceAddresses
+	localAddresses func(iface string, subnets []string) ([]string, error)
+}
+
+// publish Update the annotation on the own node if the local
+// addresses differ. Nothing is done if no local addresses are found,
+// e.g. when an interface is re-configured, since that would make
+// other nodes remove their routes to this node.
+func (p *addressPublisher) publish(ctx context.Context, nodes []k8s.Node) error {
+	logger := logr.FromContextOrDiscard(ctx)
+	myself := getOwnNodeName(ctx, nodes)
+	n := util.FindNode(ctx, nodes, myself)
+	if n == nil {
+		return fmt.Errorf("Own node not found")
+	}
+	localAddresses := p.localAddresses
+	if localAddresses == nil {
+		localAddresses = util.GetInterfaceAddresses
+	}
+	addrs, err := localAddresses(p.iface, p.subnets)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		logger.Info("No local addresses to publish",
+			"interface", p.iface, "subnets", p.subnets)
+		return nil
+	}
+	value := strings.Join(addrs, ",")
+	if n.ObjectMeta.Annotations[p.annotation] == value {
+		return nil
+	}
+	if p.dryRun {
+		logger.Info("Dry-run, would publish addresses",
+			"annotation", p.annotation, "value", value)
+		return nil
+	}
+	logger.Info("Publish addresses", "annotation", p.annotation, "value", value)
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{p.annotation: value},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	toctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	_, err = p.client.CoreV1().Nodes().Patch(
+		toctx, myself, types.MergePatchType, data, meta.PatchOptions{})
+	return err
+}
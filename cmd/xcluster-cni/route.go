@@ -2,73 +2,537 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Nordix/xcluster-cni/pkg/util"
 	"github.com/go-logr/logr"
 	k8s "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 // syncHandler The class for route-sync. If annotations are empty ("")
 // the K8s fields in the Node object are used. The protocol MAY be a
 // string if "/etc/iproute2/rt_protos" is updated, but more common
 // (and safer) is to use a number.
+//
+// If a vrf is set, the VRF device is created with the vrfTable and
+// the vrfInterfaces are enslaved to it on each sync. The route
+// handler must use the vrfTable.
+//
+// If ownCidrRoute is "blackhole" or "unreachable", a route of that
+// type is created for the own node's POD CIDRs. Traffic to
+// unallocated addresses will then not follow the default route. The
+// route has a high metric (ownCidrMetric) so it doesn't interfere with
+// the route to the POD bridge.
+//
+// If a rule handler (ruh) is set, policy routing rules are maintained
+// that directs traffic from the own POD CIDRs, and to the POD CIDRs
+// of other nodes, to the routing table used by the route handler.
+//
+// The src, metric and mtu are optional route attributes. The src is
+// "auto", which means that the local address on the same subnet as
+// the gateway is used, or a comma separated list of addresses (one
+// per family).
 type syncHandler struct {
 	rh                util.RouteHandler
+	ruh               util.RuleHandler
 	protocol          string
 	cidrAnnotation    string
 	addressAnnotation string
+	src               string
+	metric            int
+	mtu               int
+	vrf               string
+	vrfTable          int
+	vrfInterfaces     []string
+	ownCidrRoute      string
+	// dryRun If set, the route changes are planned but not made
+	dryRun bool
+	// deleteGuard Refuse mass deletion of routes, see guardDeletes()
+	deleteGuard deleteGuard
+	// nodeSelector If set, only selected nodes are part of the
+	// network. If the own node is not selected, no routes are set
+	nodeSelector labels.Selector
+	// localAddress may be set in unit-test. Default is
+	// util.GetLocalAddress
+	localAddress func(ip string) (string, error)
+	// setupVrf may be set in unit-test. Default is util.SetupVrf
+	setupVrf func(
+		ctx context.Context, name string, table int, interfaces []string) error
+}
+
+// syncResult The result of a route sync. Nodes is the number of other
+// nodes that routes are set to. Failed route (and rule) operations
+// are collected, and the sync should be retried. Refused is the
+// number of deletions refused by the delete guard
+type syncResult struct {
+	Nodes    int           `json:"nodes"`
+	Routes   int           `json:"routes"`
+	Added    int           `json:"added"`
+	Replaced int           `json:"replaced"`
+	Deleted  int           `json:"deleted"`
+	Refused  int           `json:"refused,omitempty"`
+	Failures []syncFailure `json:"failures,omitempty"`
+	Plan     *routePlan    `json:"plan,omitempty"`
+	// Conflicts POD CIDRs that are not routed since they overlap
+	// with CIDRs of other nodes
+	Conflicts []cidrConflict `json:"conflicts,omitempty"`
+	// Problems Nodes, or POD CIDRs, that are not routed
+	Problems []nodeProblem `json:"problems,omitempty"`
+	// want The wanted routes with the canonical Dst as key
+	want map[string]util.Route
+}
+
+// nodeProblem A problem with a node that prevents routing to the
+// node, or to some of its POD CIDRs. The reason is one of the
+// "reason" constants
+type nodeProblem struct {
+	Node    string `json:"node"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// Reasons for node problems. Used as K8s Event reasons
+const (
+	reasonNoNodeAddresses = "NoNodeAddresses"
+	reasonNoPodCidrs      = "NoPodCIDRs"
+	reasonParseFailed     = "CIDRParseFailed"
+	reasonNoGateway       = "NoGateway"
+	reasonCidrConflict    = "CIDRConflict"
+	// reasonAddressParseFailed A node address, or its weight, is
+	// invalid. The node is routed via its other addresses
+	reasonAddressParseFailed = "AddressParseFailed"
+)
+
+// problem Record a node problem. Problems are logged by the caller
+func (r *syncResult) problem(node, reason, message string) {
+	r.Problems = append(r.Problems, nodeProblem{
+		Node: node, Reason: reason, Message: message})
+}
+
+// syncFailure A failed operation. Op is "set", "delete", "verify",
+// "add-rule" or "delete-rule"
+type syncFailure struct {
+	Op    string      `json:"op"`
+	Route *util.Route `json:"route,omitempty"`
+	Rule  *util.Rule  `json:"rule,omitempty"`
+	Error string      `json:"error"`
+}
+
+// failRoute Record and log a failed route operation
+func (r *syncResult) failRoute(
+	ctx context.Context, op string, route util.Route, err error) {
+	logr.FromContextOrDiscard(ctx).Error(err, "Route failed", "op", op, "route", route)
+	r.Failures = append(r.Failures, syncFailure{
+		Op: op, Route: &route, Error: err.Error()})
+}
+
+// failRule Record and log a failed rule operation
+func (r *syncResult) failRule(
+	ctx context.Context, op string, rule util.Rule, err error) {
+	logr.FromContextOrDiscard(ctx).Error(err, "Rule failed", "op", op, "rule", rule)
+	r.Failures = append(r.Failures, syncFailure{
+		Op: op, Rule: &rule, Error: err.Error()})
+}
+
+// routePlan The route changes needed to get from the existing routes
+// to the wanted routes. Lists are sorted on Dst
+type routePlan struct {
+	Add     []util.Route   `json:"add,omitempty"`
+	Replace []routeReplace `json:"replace,omitempty"`
+	Delete  []util.Route   `json:"delete,omitempty"`
+}
+
+// routeReplace An existing route (From) that is replaced (To)
+type routeReplace struct {
+	From util.Route `json:"from"`
+	To   util.Route `json:"to"`
+}
+
+// empty Returns true if no changes are planned
+func (p *routePlan) empty() bool {
+	return len(p.Add) == 0 && len(p.Replace) == 0 && len(p.Delete) == 0
 }
 
 // syncRoutes Ensure that routes defined by the nodes exists or are
 // created. Delete superfluous routes. Only routes that matches the
-// "protocol" are handled
-func (h *syncHandler) syncRoutes(ctx context.Context, nodes []k8s.Node) error {
+// "protocol" are handled. Failed route operations are collected in
+// the result. An error is returned if the sync couldn't be performed
+// at all. In dry-run mode the planned changes are returned in the
+// result, but nothing is changed.
+func (h *syncHandler) syncRoutes(
+	ctx context.Context, nodes []k8s.Node) (*syncResult, error) {
 	// 1. Create a Route map from the nodes with the canonical Dst as key
-	// 2. Create a map of the existing routes. Canonical Dst can be assumed
-	// 3. Add all routes that doesn't exist or differs
-	// 5. Run through the map of the existing routes and delete superfluous
+	// 2. Plan the changes from the existing routes
+	// 3. Delete superfluous routes, and add or replace routes
+	// 4. Read back the routes to verify that the kernel holds them
+
+	if h.vrf != "" && !h.dryRun {
+		// Interfaces, like a POD bridge, may be created later, so
+		// this is done on every sync
+		setupVrf := h.setupVrf
+		if setupVrf == nil {
+			setupVrf = util.SetupVrf
+		}
+		err := setupVrf(ctx, h.vrf, h.vrfTable, h.vrfInterfaces)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	myself := getOwnNodeName(ctx, nodes)
 	logger := logr.FromContextOrDiscard(ctx)
-	want := make(map[string]util.Route, len(nodes))
-	for _, n := range nodes {
-		if n.ObjectMeta.Name == myself {
+	nodes = h.selectNodes(ctx, nodes, myself)
+	var result syncResult
+	want := h.computeRoutes(ctx, nodes, myself, &result)
+
+	present, err := h.rh.GetRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	logger.V(2).Info("Existing routes", "routes", present)
+	plan := h.planRoutes(want, present)
+	result.Plan = plan
+	if h.dryRun {
+		return &result, nil
+	}
+
+	deletes := plan.Delete
+	if h.guardDeletes(ctx, want, present, plan) {
+		// Only duplicates are deleted
+		deletes = nil
+		for _, r := range plan.Delete {
+			if _, ok := want[r.Dst]; ok {
+				deletes = append(deletes, r)
+			}
+		}
+		result.Refused = len(plan.Delete) - len(deletes)
+	}
+	for _, r := range deletes {
+		if err := h.rh.Delete(ctx, &r); err != nil {
+			result.failRoute(ctx, "delete", r, err)
+		} else {
+			result.Deleted++
+		}
+	}
+	var set []util.Route
+	for _, r := range plan.Add {
+		if err := h.rh.Set(ctx, &r); err != nil {
+			result.failRoute(ctx, "set", r, err)
 			continue
 		}
-		var nodeAddresses []string
-		if h.addressAnnotation != "" {
-			// Get the node addresses from the annotation
-			if a, ok := n.ObjectMeta.Annotations[h.addressAnnotation]; ok {
-				nodeAddresses = strings.Split(a, ",")
+		set = append(set, r)
+		result.Added++
+	}
+	for _, r := range plan.Replace {
+		if r.From.EffectiveMetric() != r.To.EffectiveMetric() {
+			// A "replace" would add a route, not replace it
+			if err := h.rh.Delete(ctx, &r.From); err != nil {
+				result.failRoute(ctx, "delete", r.From, err)
 			}
-		} else {
-			// Get the node addresses from ".status.addresses"
-			for _, a := range n.Status.Addresses {
-				if a.Type == "InternalIP" {
-					nodeAddresses = append(nodeAddresses, a.Address)
+		}
+		if err := h.rh.Set(ctx, &r.To); err != nil {
+			result.failRoute(ctx, "set", r.To, err)
+			continue
+		}
+		set = append(set, r.To)
+		result.Replaced++
+	}
+	if len(set) > 0 {
+		h.verifyRoutes(ctx, set, &result)
+	}
+	if p, ok := h.rh.(util.NexthopPruner); ok {
+		if err := p.PruneNexthops(ctx); err != nil {
+			logger.Error(err, "PruneNexthops")
+		}
+	}
+
+	if h.ruh != nil {
+		var rules []util.Rule
+		if n := util.FindNode(ctx, nodes, myself); n != nil {
+			for _, c := range h.podCidrs(n) {
+				if dst, family := canonicalCidr(c); family != 0 {
+					rules = append(rules, util.Rule{Src: dst})
 				}
 			}
 		}
-		if len(nodeAddresses) == 0 {
-			logger.Info("No node addresses", "node", n.ObjectMeta.Name)
+		for dst, r := range want {
+			if r.Type == "" {
+				rules = append(rules, util.Rule{Dst: dst})
+			}
+		}
+		if err := h.syncRules(ctx, rules, &result); err != nil {
+			return nil, err
+		}
+	}
+	return &result, nil
+}
+
+// computeRoutes Returns the wanted routes with the canonical Dst as
+// key, and records the number of routes and routed nodes, conflicts
+// and node problems in the result. The nodes should be selected with
+// selectNodes. Nothing is read from, or changed in, the kernel, so
+// this can be used for simulations
+func (h *syncHandler) computeRoutes(
+	ctx context.Context, nodes []k8s.Node, myself string,
+	result *syncResult) map[string]util.Route {
+	want := h.wantedRoutes(ctx, nodes, myself, result)
+	result.Routes = len(want)
+	result.want = want
+	routed := make(map[string]bool)
+	for _, r := range want {
+		if r.Node != myself {
+			routed[r.Node] = true
+		}
+	}
+	result.Nodes = len(routed)
+	return want
+}
+
+// selectNodes Returns the nodes selected by the nodeSelector. If the
+// own node is not selected, no nodes are returned
+func (h *syncHandler) selectNodes(
+	ctx context.Context, nodes []k8s.Node, myself string) []k8s.Node {
+	if h.nodeSelector == nil {
+		return nodes
+	}
+	selected := h.networkNodes(nodes)
+	if util.FindNode(ctx, selected, myself) == nil {
+		return nil
+	}
+	return selected
+}
+
+// networkNodes Returns the nodes selected by the nodeSelector,
+// regardless of the own node
+func (h *syncHandler) networkNodes(nodes []k8s.Node) []k8s.Node {
+	if h.nodeSelector == nil {
+		return nodes
+	}
+	selected := make([]k8s.Node, 0, len(nodes))
+	for _, n := range nodes {
+		if h.nodeSelector.Matches(labels.Set(n.ObjectMeta.Labels)) {
+			selected = append(selected, n)
+		}
+	}
+	return selected
+}
+
+// planRoutes Returns the changes needed to get from the present routes
+// to the wanted routes
+func (h *syncHandler) planRoutes(
+	want map[string]util.Route, present []util.Route) *routePlan {
+	var plan routePlan
+	got := make(map[string]util.Route, len(present))
+	for _, r := range present {
+		if _, ok := got[r.Dst]; ok {
+			// Same Dst with another metric
+			plan.Delete = append(plan.Delete, r)
 			continue
 		}
+		got[r.Dst] = r
+	}
 
-		var podCidrs []string
-		if h.cidrAnnotation != "" {
-			// Get the POD CIDRs from the annotation
-			if a, ok := n.ObjectMeta.Annotations[h.cidrAnnotation]; ok {
-				podCidrs = strings.Split(a, ",")
+	// Routes are migrated if nexthop objects are enabled or disabled
+	_, useNexthops := h.rh.(util.NexthopPruner)
+	for k, v := range want {
+		if c, ok := got[k]; ok {
+			nexthop := useNexthops && v.Type == ""
+			if util.RoutesEqual(&v, &c) && (c.NexthopID != 0) == nexthop {
+				continue
 			}
+			plan.Replace = append(plan.Replace, routeReplace{From: c, To: v})
 		} else {
-			// Get the POD CIDRs from .spec.podCIDRs
-			podCidrs = n.Spec.PodCIDRs
+			plan.Add = append(plan.Add, v)
+		}
+	}
+	for k, v := range got {
+		if _, ok := want[k]; !ok {
+			plan.Delete = append(plan.Delete, v)
+		}
+	}
+
+	sort.Slice(plan.Add, func(i, j int) bool {
+		return plan.Add[i].Dst < plan.Add[j].Dst
+	})
+	sort.Slice(plan.Replace, func(i, j int) bool {
+		return plan.Replace[i].To.Dst < plan.Replace[j].To.Dst
+	})
+	sort.SliceStable(plan.Delete, func(i, j int) bool {
+		return plan.Delete[i].Dst < plan.Delete[j].Dst
+	})
+	return &plan
+}
+
+// deleteGuardMinRoutes The default minimum number of routes to other
+// nodes for the delete guard to apply. Deleting fewer routes is not a
+// mass deletion, and in small clusters the last routes may be deleted
+// legitimately
+const deleteGuardMinRoutes = 4
+
+// deleteGuard Configuration and state of the guard against mass
+// deletion of routes. The guard is disabled if share is 0 (zero).
+type deleteGuard struct {
+	// share Refuse if more than this percentage of the existing
+	// routes would be deleted
+	share int
+	// period Go ahead when the condition has persisted this long. 0
+	// (zero) means never
+	period time.Duration
+	// minRoutes The guard only applies if at least this many routes
+	// to other nodes exist. 0 (zero) means deleteGuardMinRoutes
+	minRoutes int
+	// override If this file exists, deletions are allowed once, and
+	// the file is removed
+	override string
+	// since The time when the condition was first detected
+	since time.Time
+}
+
+// guardDeletes Returns true if the planned deletions should be
+// refused. That is if more than a share of the existing routes to
+// other nodes would be deleted, or if no such routes would be left,
+// provided that at least minRoutes routes to other nodes exist. This
+// happens if the node list is empty or truncated, e.g. on RBAC
+// problems, an API hiccup or a wrong annotation name, and would take
+// down the POD network. The routes for own POD CIDRs (blackhole or
+// unreachable) are not counted.
+func (h *syncHandler) guardDeletes(
+	ctx context.Context, want map[string]util.Route,
+	present []util.Route, plan *routePlan) bool {
+	g := &h.deleteGuard
+	if g.share == 0 {
+		return false
+	}
+	minRoutes := g.minRoutes
+	if minRoutes == 0 {
+		minRoutes = deleteGuardMinRoutes
+	}
+	routes := 0
+	for _, r := range present {
+		if r.Type == "" {
+			routes++
+		}
+	}
+	if routes < minRoutes {
+		g.since = time.Time{}
+		return false
+	}
+	wanted := 0
+	for _, r := range want {
+		if r.Type == "" {
+			wanted++
+		}
+	}
+	deletes := 0
+	for _, r := range plan.Delete {
+		if _, ok := want[r.Dst]; !ok && r.Type == "" {
+			deletes++
+		}
+	}
+	if deletes == 0 || (wanted > 0 && deletes*100 <= g.share*routes) {
+		g.since = time.Time{}
+		return false
+	}
+
+	logger := logr.FromContextOrDiscard(ctx)
+	if g.override != "" {
+		if err := os.Remove(g.override); err == nil {
+			logger.Info("Mass route deletion allowed by override",
+				"deletes", deletes, "routes", routes)
+			g.since = time.Time{}
+			return false
+		}
+	}
+	if g.since.IsZero() {
+		g.since = time.Now()
+	}
+	if g.period > 0 && time.Since(g.since) >= g.period {
+		logger.Info("Mass route deletion allowed after period",
+			"deletes", deletes, "routes", routes, "since", g.since)
+		g.since = time.Time{}
+		return false
+	}
+	logger.Error(fmt.Errorf("Mass route deletion refused"), "ALERT",
+		"deletes", deletes, "routes", routes, "wanted", wanted,
+		"since", g.since)
+	return true
+}
+
+// verifyRoutes Read back the routes that has been set to confirm that
+// the kernel actually holds them. With nexthop objects, routes with
+// next hops must also refer to a nexthop object
+func (h *syncHandler) verifyRoutes(
+	ctx context.Context, routes []util.Route, result *syncResult) {
+	_, useNexthops := h.rh.(util.NexthopPruner)
+	present, err := h.rh.GetRoutes(ctx)
+	if err != nil {
+		for _, r := range routes {
+			result.failRoute(ctx, "verify", r, err)
+		}
+		return
+	}
+	got := make(map[string]util.Route, len(present))
+	for _, r := range present {
+		got[r.Dst] = r
+	}
+	for _, r := range routes {
+		c, ok := got[r.Dst]
+		if !ok || !util.RoutesEqual(&r, &c) {
+			result.failRoute(ctx, "verify", r, fmt.Errorf("Route not found"))
+			continue
+		}
+		if useNexthops && r.Type == "" && c.NexthopID == 0 {
+			result.failRoute(ctx, "verify", r, fmt.Errorf("No nexthop object"))
 		}
+	}
+}
+
+// wantedRoutes Returns the routes defined by the nodes with the
+// canonical Dst as key. POD CIDRs in conflict with CIDRs of other
+// nodes are not routed. Conflicts, and problems with nodes that
+// prevent routing, are recorded in the result. The own node is
+// checked for problems, but not routed
+func (h *syncHandler) wantedRoutes(
+	ctx context.Context, nodes []k8s.Node, myself string,
+	result *syncResult) map[string]util.Route {
+	logger := logr.FromContextOrDiscard(ctx)
+	want := make(map[string]util.Route, len(nodes))
+	result.Conflicts = h.findConflicts(nodes, myself)
+	excluded := make(map[nodeCidr]bool, len(result.Conflicts))
+	for _, c := range result.Conflicts {
+		logger.Info("CIDR conflict", "node", c.Node, "CIDR", c.Cidr,
+			"other", c.Other, "otherCIDR", c.OtherCidr)
+		excluded[nodeCidr{node: c.Node, cidr: c.Cidr}] = true
+		result.problem(c.Node, reasonCidrConflict, fmt.Sprintf(
+			"CIDR %s conflicts with %s of node %s", c.Cidr, c.OtherCidr, c.Other))
+	}
+	for _, n := range nodes {
+		name := n.ObjectMeta.Name
+		nodeAddresses := h.nodeAddresses(&n)
+		if len(nodeAddresses) == 0 {
+			logger.Info("No node addresses", "node", name)
+			result.problem(name, reasonNoNodeAddresses, "No node addresses")
+			continue
+		}
+
+		for _, a := range nodeAddresses {
+			if _, _, err := parseAddress(a); err != nil {
+				logger.Info("Invalid node address", "node", name, "error", err)
+				result.problem(name, reasonAddressParseFailed, err.Error())
+			}
+		}
+
+		podCidrs := h.podCidrs(&n)
 		if len(podCidrs) == 0 {
-			logger.Info("No POD CIDRs", "node", n.ObjectMeta.Name)
+			logger.Info("No POD CIDRs", "node", name)
+			result.problem(name, reasonNoPodCidrs, "No POD CIDRs")
 			continue
 		}
 		logger.V(2).Info(
@@ -78,34 +542,61 @@ func (h *syncHandler) syncRoutes(ctx context.Context, nodes []k8s.Node) error {
 		// We have collected the node addresses and POD CIDRs for the
 		// node.
 
-		handledFamily := 0
-		for i, c := range podCidrs {
-			if i > 1 {
-				logger.Info("POD CIDRs", "len", len(podCidrs))
-				break
-			}
+		// All CIDRs are routed, also several of the same family,
+		// e.g. if a range is added when the first is exhausted
+		for _, c := range podCidrs {
 			dst, family := canonicalCidr(c)
 			if family == 0 {
-				logger.Info("Parse failed", "CIDR", c)
+				logger.Info("Parse failed", "node", name, "CIDR", c)
+				result.problem(name, reasonParseFailed,
+					fmt.Sprintf("Parse failed, CIDR %s", c))
 				continue
 			}
-			if handledFamily == 0 {
-				handledFamily = family
-			} else {
-				if handledFamily == family {
-					logger.Info("Same family", "CIDRs", podCidrs)
-					break
-				}
+			if excluded[nodeCidr{node: name, cidr: dst}] {
+				continue
 			}
-			gw := findAdr(family, nodeAddresses)
-			if gw == "" {
-				logger.Info("No Gateway", "family", family, "CIDR", c)
+			nexthops := findNexthops(family, nodeAddresses)
+			if len(nexthops) == 0 {
+				logger.Info("No Gateway", "node", name,
+					"family", family, "CIDR", c)
+				result.problem(name, reasonNoGateway, fmt.Sprintf(
+					"No Gateway for CIDR %s, no IPv%d node address", c, family))
 				continue
 			}
-			want[dst] = util.Route{
+			if name == myself {
+				continue
+			}
+			r := util.Route{
 				Dst:      dst,
-				Gateway:  gw,
 				Protocol: h.protocol,
+				Node:     name,
+			}
+			if len(nexthops) == 1 {
+				r.Gateway = nexthops[0].Gateway
+			} else {
+				r.Nexthops = nexthops
+			}
+			r.Src = h.routeSrc(ctx, family, nexthops[0].Gateway)
+			r.Metric = h.metric
+			r.MTU = h.mtu
+			want[dst] = r
+		}
+	}
+	if h.ownCidrRoute != "" {
+		if n := util.FindNode(ctx, nodes, myself); n != nil {
+			for _, c := range h.podCidrs(n) {
+				dst, family := canonicalCidr(c)
+				if family == 0 {
+					logger.Info("Parse failed", "CIDR", c)
+					continue
+				}
+				want[dst] = util.Route{
+					Type:     h.ownCidrRoute,
+					Dst:      dst,
+					Protocol: h.protocol,
+					Metric:   ownCidrMetric,
+					Node:     myself,
+				}
 			}
 		}
 	}
@@ -117,28 +608,241 @@ func (h *syncHandler) syncRoutes(ctx context.Context, nodes []k8s.Node) error {
 		traceLogger.Info("Wanted routes", "routes", wantedRoutes)
 	}
 
-	present, err := h.rh.GetRoutes(ctx)
+	return want
+}
+
+// cidrConflict A POD CIDR of a node that is a duplicate of, contains,
+// or is contained in, a CIDR of another node
+type cidrConflict struct {
+	Node      string `json:"node"`
+	Cidr      string `json:"cidr"`
+	Other     string `json:"other"`
+	OtherCidr string `json:"otherCidr"`
+}
+
+// nodeCidr A canonical POD CIDR of a node
+type nodeCidr struct {
+	node string
+	cidr string
+}
+
+// findConflicts Returns POD CIDRs that overlap with CIDRs of other
+// nodes. To be deterministic, the nodes are taken in order; the own
+// node first, then the oldest node, and then by name. A CIDR that
+// overlaps with a CIDR of a node earlier in order is a conflict, and
+// the earlier node keeps its CIDR. So a new node with a bad
+// annotation doesn't break routing to existing nodes
+func (h *syncHandler) findConflicts(
+	nodes []k8s.Node, myself string) []cidrConflict {
+	sorted := make([]*k8s.Node, len(nodes))
+	for i := range nodes {
+		sorted[i] = &nodes[i]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if (a.ObjectMeta.Name == myself) != (b.ObjectMeta.Name == myself) {
+			return a.ObjectMeta.Name == myself
+		}
+		ta, tb := a.ObjectMeta.CreationTimestamp, b.ObjectMeta.CreationTimestamp
+		if !ta.Equal(&tb) {
+			return ta.Before(&tb)
+		}
+		return a.ObjectMeta.Name < b.ObjectMeta.Name
+	})
+
+	var conflicts []cidrConflict
+	var accepted []nodeCidr
+	var acceptedNets []*net.IPNet
+	for _, n := range sorted {
+		name := n.ObjectMeta.Name
+		nAccepted := len(accepted)
+		for _, c := range h.podCidrs(n) {
+			_, ipNet, err := net.ParseCIDR(c)
+			if err != nil {
+				continue // Logged by wantedRoutes
+			}
+			// CIDRs of the same node are not checked against each other
+			conflict := false
+			for i := 0; i < nAccepted; i++ {
+				other := acceptedNets[i]
+				if other.Contains(ipNet.IP) || ipNet.Contains(other.IP) {
+					conflicts = append(conflicts, cidrConflict{
+						Node:      name,
+						Cidr:      ipNet.String(),
+						Other:     accepted[i].node,
+						OtherCidr: accepted[i].cidr,
+					})
+					conflict = true
+					break
+				}
+			}
+			if !conflict {
+				accepted = append(accepted, nodeCidr{node: name, cidr: ipNet.String()})
+				acceptedNets = append(acceptedNets, ipNet)
+			}
+		}
+	}
+	return conflicts
+}
+
+// ownCidrMetric The metric for routes to the own POD CIDRs. Must be
+// higher than the metric of the route to the POD bridge
+const ownCidrMetric = 4096
+
+// syncRules Ensure that the passed rules exists and delete all other
+// rules handled by the rule handler
+func (h *syncHandler) syncRules(
+	ctx context.Context, rules []util.Rule, result *syncResult) error {
+	present, err := h.ruh.GetRules(ctx)
 	if err != nil {
 		return err
 	}
-	logger.V(2).Info("Existing routes", "routes", present)
-	got := make(map[string]util.Route, len(present))
+	for _, r := range rules {
+		if !containsRule(present, &r) {
+			if err := h.ruh.Add(ctx, &r); err != nil {
+				result.failRule(ctx, "add-rule", r, err)
+			}
+		}
+	}
 	for _, r := range present {
-		got[r.Dst] = r
+		if !containsRule(rules, &r) {
+			if err := h.ruh.Delete(ctx, &r); err != nil {
+				result.failRule(ctx, "delete-rule", r, err)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteRules Delete all rules handled by the rule handler. Called on
+// shutdown
+func (h *syncHandler) deleteRules(ctx context.Context) error {
+	if h.ruh == nil || h.dryRun {
+		return nil
+	}
+	var result syncResult
+	if err := h.syncRules(ctx, nil, &result); err != nil {
+		return err
 	}
+	if len(result.Failures) > 0 {
+		return fmt.Errorf("Failed to delete %d rules", len(result.Failures))
+	}
+	return nil
+}
 
-	for k, v := range want {
-		if c, ok := got[k]; ok {
-			if util.RoutesEqual(&v, &c) {
-				//logger.V(2).Info("Same route", "want", v, "got", c)
-				continue
+// cleanup Delete all routes, nexthop objects and rules handled by the
+// syncHandler. Called when a network is removed. A VRF is not removed
+func (h *syncHandler) cleanup(ctx context.Context) error {
+	if h.dryRun {
+		return nil
+	}
+	routes, err := h.rh.GetRoutes(ctx)
+	if err != nil {
+		return err
+	}
+	var result syncResult
+	for _, r := range routes {
+		if err := h.rh.Delete(ctx, &r); err != nil {
+			result.failRoute(ctx, "delete", r, err)
+		}
+	}
+	if p, ok := h.rh.(util.NexthopPruner); ok {
+		if err := p.PruneNexthops(ctx); err != nil {
+			return err
+		}
+	}
+	if err := h.deleteRules(ctx); err != nil {
+		return err
+	}
+	if len(result.Failures) > 0 {
+		return fmt.Errorf("Failed to delete %d routes", len(result.Failures))
+	}
+	return nil
+}
+
+// containsRule Returns true if the rule is in the slice
+func containsRule(rules []util.Rule, rule *util.Rule) bool {
+	for _, r := range rules {
+		if util.RulesEqual(&r, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeAddresses Returns the node addresses from the annotation, or
+// from ".status.addresses" if no annotation is configured
+func (h *syncHandler) nodeAddresses(n *k8s.Node) []string {
+	var nodeAddresses []string
+	if h.addressAnnotation != "" {
+		// Get the node addresses from the annotation. An empty value
+		// is the same as a missing annotation
+		if a := n.ObjectMeta.Annotations[h.addressAnnotation]; a != "" {
+			nodeAddresses = strings.Split(a, ",")
+		}
+	} else {
+		// Get the node addresses from ".status.addresses"
+		for _, a := range n.Status.Addresses {
+			if a.Type == "InternalIP" {
+				nodeAddresses = append(nodeAddresses, a.Address)
 			}
 		}
-		h.rh.Set(ctx, &v)
 	}
-	for k, v := range got {
-		if _, ok := want[k]; !ok {
-			h.rh.Delete(ctx, &v)
+	return nodeAddresses
+}
+
+// podCidrs Returns the POD CIDRs from the annotation, or from
+// ".spec.podCIDRs" if no annotation is configured
+func (h *syncHandler) podCidrs(n *k8s.Node) []string {
+	if h.cidrAnnotation != "" {
+		// Get the POD CIDRs from the annotation. An empty value is
+		// the same as a missing annotation
+		if a := n.ObjectMeta.Annotations[h.cidrAnnotation]; a != "" {
+			return strings.Split(a, ",")
+		}
+		return nil
+	}
+	// Get the POD CIDRs from .spec.podCIDRs
+	return n.Spec.PodCIDRs
+}
+
+// routeSrc Returns the preferred source for a route via the passed
+// gateway, or "" if not configured or not found
+func (h *syncHandler) routeSrc(ctx context.Context, family int, gw string) string {
+	switch h.src {
+	case "":
+		return ""
+	case "auto":
+		localAddress := h.localAddress
+		if localAddress == nil {
+			localAddress = util.GetLocalAddress
+		}
+		src, err := localAddress(gw)
+		if err != nil {
+			logr.FromContextOrDiscard(ctx).Info(
+				"No source address", "gateway", gw, "error", err)
+			return ""
+		}
+		return src
+	}
+	for _, a := range strings.Split(h.src, ",") {
+		ip := net.ParseIP(strings.TrimSpace(a))
+		if ip != nil && (family == 4) == (ip.To4() != nil) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// checkRouteSrc Returns an error if the source is not "", "auto" or
+// a comma separated list of addresses
+func checkRouteSrc(src string) error {
+	if src == "" || src == "auto" {
+		return nil
+	}
+	for _, a := range strings.Split(src, ",") {
+		if net.ParseIP(strings.TrimSpace(a)) == nil {
+			return fmt.Errorf("Invalid source address %s", a)
 		}
 	}
 	return nil
@@ -158,21 +862,52 @@ func canonicalCidr(c string) (string, int) {
 	return ipNet.String(), family
 }
 
-// findAdr Returns the first found address that matches the passed family
-// The returned address is in canonical form
-func findAdr(family int, addresses []string) string {
+// findNexthops Returns next hops for all addresses that matches the
+// passed family. Duplicates are ignored. The returned addresses are
+// in canonical form
+func findNexthops(family int, addresses []string) []util.Nexthop {
+	var nexthops []util.Nexthop
+	found := make(map[string]bool)
 	for _, a := range addresses {
-		ip := net.ParseIP(a)
-		if ip != nil {
-			if family == 4 && ip.To4() != nil {
-				return ip.String()
-			}
-			if family == 6 && ip.To4() == nil {
-				return ip.String()
-			}
+		ip, weight, err := parseAddress(a)
+		if err != nil {
+			continue
+		}
+		if (family == 4) != (ip.To4() != nil) {
+			continue
+		}
+		if found[ip.String()] {
+			continue
 		}
+		found[ip.String()] = true
+		nexthops = append(nexthops, util.Nexthop{
+			Gateway: ip.String(),
+			Weight:  weight,
+		})
 	}
-	return ""
+	return nexthops
+}
+
+// parseAddress Parse a node address with an optional weight, used
+// for multipath routes, in the form "address*weight". The weight is 0
+// (zero) if not specified, and must be 1..util.MaxNexthopWeight
+// otherwise. A nil address and an error is returned on failure
+func parseAddress(a string) (net.IP, int, error) {
+	weight := 0
+	adr, w, found := strings.Cut(strings.TrimSpace(a), "*")
+	ip := net.ParseIP(strings.TrimSpace(adr))
+	if ip == nil {
+		return nil, 0, fmt.Errorf("Parse failed, address %s", a)
+	}
+	if found {
+		var err error
+		if weight, err = strconv.Atoi(w); err != nil ||
+			weight < 1 || weight > util.MaxNexthopWeight {
+			return nil, 0, fmt.Errorf("Weight not in 1..%d, address %s",
+				util.MaxNexthopWeight, a)
+		}
+	}
+	return ip, weight, nil
 }
 
 // getOwnNodeName Returns the own node name
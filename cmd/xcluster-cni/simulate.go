@@ -0,0 +1,200 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// cmdSimulate Compute the routes that a sync on a node would want,
+// from a list of nodes in a file. Neither the K8s API, nor the kernel,
+// is used.
+func cmdSimulate(ctx context.Context, args []string) int {
+	flagset := flag.NewFlagSet("simulate", flag.ExitOnError)
+	flagset.Usage = func() {
+		fmt.Fprintf(flagset.Output(), `Syntax: simulate [options]
+
+  Read Node objects, e.g. from "xcluster-cni nodes" or
+  "kubectl get nodes -o json", and print the routes the own node
+  would want, and problems with nodes that are not routed.
+  The network is defined by a config file, by environment variables
+  as for the daemon, or by options.
+
+`)
+		flagset.PrintDefaults()
+	}
+	nodesFile := flagset.String("nodes", "-", "File with Node objects, JSON or YAML. '-' is stdin")
+	myself := flagset.String("node", os.Getenv("NODE_NAME"), "The own node name")
+	nf := addNetworkFlags(flagset)
+	if err := flagset.Parse(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *myself == "" {
+		fmt.Fprintln(os.Stderr, "The own node name must be specified")
+		return 1
+	}
+	networks, err := nf.networks()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	nodes, err := readNodes(*nodesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if util.FindNode(ctx, nodes, *myself) == nil {
+		fmt.Fprintf(os.Stderr, "Own node %s not found\n", *myself)
+		return 1
+	}
+	// Node problems are in the output, so the log is not needed
+	ctx = logr.NewContext(ctx, logr.Discard())
+	for i := range networks {
+		sim, err := simulate(ctx, &networks[i], nodes, *myself)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Network %s: %v\n", networks[i].Name, err)
+			return 1
+		}
+		util.EmitJson(sim)
+	}
+	return 0
+}
+
+// simulation The result of a simulated sync. If the own node is not
+// selected, no routes are wanted
+type simulation struct {
+	Network   string         `json:"network"`
+	Node      string         `json:"node"`
+	Selected  bool           `json:"selected"`
+	Nodes     int            `json:"nodes"`
+	Routes    []util.Route   `json:"routes"`
+	Problems  []nodeProblem  `json:"problems,omitempty"`
+	Conflicts []cidrConflict `json:"conflicts,omitempty"`
+}
+
+// simulate Compute the routes a sync on the own node would want
+func simulate(ctx context.Context, n *networkConfig,
+	nodes []k8s.Node, myself string) (*simulation, error) {
+	sh, err := newOfflineSyncHandler(n)
+	if err != nil {
+		return nil, err
+	}
+	selected := sh.selectNodes(ctx, nodes, myself)
+	var result syncResult
+	want := sh.computeRoutes(ctx, selected, myself, &result)
+	return &simulation{
+		Network:   n.Name,
+		Node:      myself,
+		Selected:  selected != nil,
+		Nodes:     result.Nodes,
+		Routes:    sortedRoutes(want),
+		Problems:  result.Problems,
+		Conflicts: result.Conflicts,
+	}, nil
+}
+
+// networkFlags Options that define networks for offline sub-commands
+type networkFlags struct {
+	config            *string
+	network           *string
+	protocol          *string
+	cidrAnnotation    *string
+	addressAnnotation *string
+}
+
+// addNetworkFlags Add options for networks to a flagset
+func addNetworkFlags(flagset *flag.FlagSet) *networkFlags {
+	return &networkFlags{
+		config: flagset.String("config", os.Getenv("CONFIG_FILE"),
+			"Config file with networks"),
+		network: flagset.String("network", "",
+			"Only this network in the config file"),
+		protocol: flagset.String("protocol", "",
+			"Route protocol. Overrides env PROTOCOL"),
+		cidrAnnotation: flagset.String("cidr-annotation", "",
+			"CIDR annotation. Overrides env CIDR_ANNOTATION"),
+		addressAnnotation: flagset.String("address-annotation", "",
+			"Address annotation. Overrides env ADDRESS_ANNOTATION"),
+	}
+}
+
+// networks Returns the networks from the config file, or the network
+// defined by environment variables and options
+func (f *networkFlags) networks() ([]networkConfig, error) {
+	if *f.config != "" {
+		cfg, err := readConfig(*f.config)
+		if err != nil {
+			return nil, err
+		}
+		if *f.network == "" {
+			return cfg.Networks, nil
+		}
+		for _, n := range cfg.Networks {
+			if n.Name == *f.network {
+				return []networkConfig{n}, nil
+			}
+		}
+		return nil, fmt.Errorf("Network %s not found", *f.network)
+	}
+	cfg, err := envConfig()
+	if err != nil {
+		return nil, err
+	}
+	n := &cfg.Networks[0]
+	if *f.protocol != "" {
+		n.Protocol = *f.protocol
+	}
+	if *f.cidrAnnotation != "" {
+		n.CidrAnnotation = *f.cidrAnnotation
+	}
+	if *f.addressAnnotation != "" {
+		n.AddressAnnotation = *f.addressAnnotation
+	}
+	return cfg.Networks, nil
+}
+
+// readNodes Read Node objects from a file in JSON or YAML format. The
+// file may contain a list of nodes, or a NodeList
+func readNodes(file string) ([]k8s.Node, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseNodes(data)
+}
+
+// parseNodes Parse a list of nodes, or a NodeList
+func parseNodes(data []byte) ([]k8s.Node, error) {
+	var nodes []k8s.Node
+	if err := yaml.Unmarshal(data, &nodes); err == nil {
+		return nodes, nil
+	}
+	// "kubectl get nodes -o json" gives a "List"
+	var list k8s.NodeList
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("Not a list of nodes or a NodeList: %w", err)
+	}
+	if list.Kind != "NodeList" && list.Kind != "List" {
+		return nil, fmt.Errorf("Not a list of nodes or a NodeList: %s", list.Kind)
+	}
+	return list.Items, nil
+}
@@ -0,0 +1,293 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+)
+
+// cmdTopology Export the routing mesh of one or more networks as a
+// graph
+func cmdTopology(ctx context.Context, args []string) int {
+	flagset := flag.NewFlagSet("topology", flag.ExitOnError)
+	flagset.Usage = func() {
+		fmt.Fprintf(flagset.Output(), `Syntax: topology [options]
+
+  Print the routing mesh as a graph. Nodes are vertices labeled with
+  their POD CIDRs, and routes are edges labeled with the gateway
+  addresses, one edge per family. Nodes that are not routed, or only
+  partly routed, are highlighted. The routes are computed from the
+  Node objects as by a sync on each node.
+
+`)
+		flagset.PrintDefaults()
+	}
+	nodesFile := flagset.String("nodes", "", "File with Node objects. Default is to read from K8s")
+	output := flagset.String("o", "dot", "Output format; dot|mermaid|json")
+	nf := addNetworkFlags(flagset)
+	if err := flagset.Parse(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *output != "dot" && *output != "mermaid" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid output format %s\n", *output)
+		return 1
+	}
+	networks, err := nf.networks()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	nodes, err := loadNodes(ctx, *nodesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx = logr.NewContext(ctx, logr.Discard()) // Problems are in the graph
+	topologies := make([]*topology, 0, len(networks))
+	for i := range networks {
+		t, err := buildTopology(ctx, &networks[i], nodes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Network %s: %v\n", networks[i].Name, err)
+			return 1
+		}
+		topologies = append(topologies, t)
+	}
+	switch *output {
+	case "json":
+		util.EmitJson(topologies)
+	case "mermaid":
+		printMermaid(os.Stdout, topologies)
+	default:
+		printDot(os.Stdout, topologies)
+	}
+	return 0
+}
+
+// topology The routing mesh of a network. Nodes and edges are sorted
+type topology struct {
+	Network string         `json:"network"`
+	Nodes   []topologyNode `json:"nodes"`
+	Edges   []topologyEdge `json:"edges"`
+}
+
+// topologyNode A node in the network. A skipped node is not routed
+// at all. A node with problems, that is not skipped, is partly routed
+type topologyNode struct {
+	Name     string   `json:"name"`
+	Cidrs    []string `json:"cidrs"`
+	Skipped  bool     `json:"skipped,omitempty"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// topologyEdge The routes of a family from one node to another
+type topologyEdge struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Family   int      `json:"family"`
+	Gateways []string `json:"gateways"`
+}
+
+// buildTopology Returns the routing mesh of a network. Only nodes
+// selected by the nodeSelector are included
+func buildTopology(
+	ctx context.Context, n *networkConfig, nodes []k8s.Node) (*topology, error) {
+	sh, err := newOfflineSyncHandler(n)
+	if err != nil {
+		return nil, err
+	}
+	nodes = sh.networkNodes(nodes)
+	t := topology{
+		Network: n.Name,
+		Nodes:   make([]topologyNode, 0, len(nodes)),
+		Edges:   []topologyEdge{},
+	}
+
+	// Problems are computed as by a node outside the cluster, so
+	// all nodes are checked
+	var result syncResult
+	want := sh.computeRoutes(ctx, nodes, "", &result)
+	routed := make(map[string]bool)
+	for _, r := range want {
+		routed[r.Node] = true
+	}
+	problems := make(map[string][]string)
+	for _, p := range result.Problems {
+		problems[p.Node] = append(problems[p.Node], p.Message)
+	}
+
+	type edgeKey struct {
+		from, to string
+		family   int
+	}
+	edges := make(map[edgeKey]*topologyEdge)
+	for _, node := range nodes {
+		name := node.ObjectMeta.Name
+		tn := topologyNode{
+			Name:     name,
+			Cidrs:    []string{},
+			Skipped:  !routed[name],
+			Problems: problems[name],
+		}
+		for _, c := range sh.podCidrs(&node) {
+			if dst, family := canonicalCidr(c); family != 0 {
+				c = dst
+			}
+			tn.Cidrs = append(tn.Cidrs, c)
+		}
+		t.Nodes = append(t.Nodes, tn)
+
+		var r syncResult
+		for _, route := range sh.computeRoutes(ctx, nodes, name, &r) {
+			if route.Type != "" {
+				continue
+			}
+			_, family := canonicalCidr(route.Dst)
+			key := edgeKey{from: name, to: route.Node, family: family}
+			e, ok := edges[key]
+			if !ok {
+				e = &topologyEdge{From: name, To: route.Node, Family: family}
+				edges[key] = e
+			}
+			for _, nh := range route.NexthopList() {
+				if !contains(e.Gateways, nh.Gateway) {
+					e.Gateways = append(e.Gateways, nh.Gateway)
+				}
+			}
+		}
+	}
+	sort.Slice(t.Nodes, func(i, j int) bool {
+		return t.Nodes[i].Name < t.Nodes[j].Name
+	})
+	for _, e := range edges {
+		sort.Strings(e.Gateways)
+		t.Edges = append(t.Edges, *e)
+	}
+	sort.Slice(t.Edges, func(i, j int) bool {
+		a, b := &t.Edges[i], &t.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Family < b.Family
+	})
+	return &t, nil
+}
+
+// contains Returns true if the string is in the list
+func contains(list []string, s string) bool {
+	for _, i := range list {
+		if i == s {
+			return true
+		}
+	}
+	return false
+}
+
+// familyColor Returns the edge color of a family
+func familyColor(family int) string {
+	if family == 6 {
+		return "darkgreen"
+	}
+	return "blue"
+}
+
+// printDot Print the topologies as a Graphviz DOT graph, with one
+// cluster per network. Skipped nodes are red, and partly routed nodes
+// are orange. IPv4 edges are blue and IPv6 edges are green
+func printDot(out io.Writer, topologies []*topology) {
+	fmt.Fprintln(out, "digraph xcluster {")
+	fmt.Fprintln(out, "  node [shape=box];")
+	for _, t := range topologies {
+		id := func(node string) string {
+			return strconv.Quote(t.Network + "/" + node)
+		}
+		fmt.Fprintf(out, "  subgraph %s {\n", strconv.Quote("cluster_"+t.Network))
+		fmt.Fprintf(out, "    label=%s;\n", strconv.Quote(t.Network))
+		for _, n := range t.Nodes {
+			label := strings.Join(append([]string{n.Name}, n.Cidrs...), "\n")
+			attrs := "label=" + strconv.Quote(label)
+			switch {
+			case n.Skipped:
+				attrs += ", color=red, style=dashed"
+			case len(n.Problems) > 0:
+				attrs += ", color=orange"
+			}
+			if len(n.Problems) > 0 {
+				attrs += ", tooltip=" + strconv.Quote(strings.Join(n.Problems, "\n"))
+			}
+			fmt.Fprintf(out, "    %s [%s];\n", id(n.Name), attrs)
+		}
+		for _, e := range t.Edges {
+			fmt.Fprintf(out, "    %s -> %s [label=%s, color=%s];\n",
+				id(e.From), id(e.To), strconv.Quote(strings.Join(e.Gateways, "\n")),
+				familyColor(e.Family))
+		}
+		fmt.Fprintln(out, "  }")
+	}
+	fmt.Fprintln(out, "}")
+}
+
+// printMermaid Print the topologies as a Mermaid flowchart, with one
+// subgraph per network. Skipped nodes are red, and partly routed
+// nodes are orange. IPv4 edges are blue and IPv6 edges are green
+func printMermaid(out io.Writer, topologies []*topology) {
+	fmt.Fprintln(out, "flowchart LR")
+	fmt.Fprintln(out, "  classDef skipped stroke:red,stroke-dasharray:5 5")
+	fmt.Fprintln(out, "  classDef partial stroke:orange")
+	link := 0
+	links := map[int][]string{}
+	for i, t := range topologies {
+		ids := make(map[string]string, len(t.Nodes))
+		for j, n := range t.Nodes {
+			ids[n.Name] = fmt.Sprintf("n%d_%d", i, j)
+		}
+		fmt.Fprintf(out, "  subgraph net%d [%s]\n", i, mermaidText(t.Network))
+		for _, n := range t.Nodes {
+			label := strings.Join(append([]string{n.Name}, n.Cidrs...), "<br/>")
+			fmt.Fprintf(out, "    %s[%s]\n", ids[n.Name], mermaidText(label))
+			switch {
+			case n.Skipped:
+				fmt.Fprintf(out, "    class %s skipped\n", ids[n.Name])
+			case len(n.Problems) > 0:
+				fmt.Fprintf(out, "    class %s partial\n", ids[n.Name])
+			}
+		}
+		for _, e := range t.Edges {
+			fmt.Fprintf(out, "    %s -->|%s| %s\n", ids[e.From],
+				mermaidText(strings.Join(e.Gateways, "<br/>")), ids[e.To])
+			links[e.Family] = append(links[e.Family], strconv.Itoa(link))
+			link++
+		}
+		fmt.Fprintln(out, "  end")
+	}
+	for _, family := range []int{4, 6} {
+		if len(links[family]) > 0 {
+			fmt.Fprintf(out, "  linkStyle %s stroke:%s\n",
+				strings.Join(links[family], ","), familyColor(family))
+		}
+	}
+}
+
+// mermaidText Returns the text quoted for Mermaid. Quotes are replaced
+// since they can't be escaped
+func mermaidText(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "#quot;") + `"`
+}
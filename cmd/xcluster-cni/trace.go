@@ -0,0 +1,366 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Nordix/xcluster-cni/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+)
+
+// cmdTrace Trace the path between two POD addresses, and back
+func cmdTrace(ctx context.Context, args []string) int {
+	flagset := flag.NewFlagSet("trace", flag.ExitOnError)
+	flagset.Usage = func() {
+		fmt.Fprintf(flagset.Output(), `Syntax: trace [options] -src <ip> -dst <ip>
+
+  Find the nodes that own the POD addresses, and the routes on the
+  way from the source to the destination, and back. The routes are
+  computed from the Node objects as by a sync. The interfaces can
+  only be found on the own node. Exits with 1 if the path is broken
+  or asymmetric.
+
+`)
+		flagset.PrintDefaults()
+	}
+	src := flagset.String("src", "", "Source POD address")
+	dst := flagset.String("dst", "", "Destination POD address")
+	nodesFile := flagset.String("nodes", "", "File with Node objects. Default is to read from K8s")
+	myself := flagset.String("node", os.Getenv("NODE_NAME"),
+		"The own node name. Interfaces are looked up for routes on this node")
+	output := flagset.String("o", "text", "Output format; text|json")
+	nf := addNetworkFlags(flagset)
+	if err := flagset.Parse(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid output format %s\n", *output)
+		return 1
+	}
+	srcIP, dstIP := net.ParseIP(*src), net.ParseIP(*dst)
+	if srcIP == nil || dstIP == nil {
+		fmt.Fprintln(os.Stderr, "Source and destination addresses must be specified")
+		return 1
+	}
+	if (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+		fmt.Fprintln(os.Stderr, "Source and destination must be of the same family")
+		return 1
+	}
+	networks, err := nf.networks()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	nodes, err := loadNodes(ctx, *nodesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx = logr.NewContext(ctx, logr.Discard()) // Problems are printed
+	rc := 0
+	for i := range networks {
+		tr := tracer{myself: *myself}
+		t, err := tr.trace(ctx, &networks[i], nodes, srcIP, dstIP)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Network %s: %v\n", networks[i].Name, err)
+			return 1
+		}
+		if *output == "json" {
+			util.EmitJson(t)
+		} else {
+			printTrace(os.Stdout, t)
+		}
+		if !t.Symmetric {
+			rc = 1
+		}
+	}
+	return rc
+}
+
+// trace The path between two POD addresses in a network. Symmetric is
+// true if both paths are complete, and the return path passes the
+// same nodes in reverse order
+type trace struct {
+	Network   string     `json:"network"`
+	Src       string     `json:"src"`
+	Dst       string     `json:"dst"`
+	SrcNode   string     `json:"srcNode,omitempty"`
+	DstNode   string     `json:"dstNode,omitempty"`
+	Hops      []traceHop `json:"hops"`
+	Return    []traceHop `json:"return"`
+	Symmetric bool       `json:"symmetric"`
+	Problems  []string   `json:"problems,omitempty"`
+}
+
+// traceHop A node on the path. Route is the Dst of the route used on
+// the node, or the own POD CIDR if the address is local. Next is the
+// node the route leads to, and is empty if the address is local. The
+// interface is only known for the own node
+type traceHop struct {
+	Node      string   `json:"node"`
+	Route     string   `json:"route,omitempty"`
+	Type      string   `json:"type,omitempty"`
+	Gateways  []string `json:"gateways,omitempty"`
+	Interface string   `json:"interface,omitempty"`
+	Next      string   `json:"next,omitempty"`
+}
+
+// tracer Traces paths. Routes are computed as by a sync on each node
+type tracer struct {
+	sh     *syncHandler
+	nodes  []k8s.Node
+	myself string
+	// localInterface may be set in unit-test. Default is
+	// util.GetInterface
+	localInterface func(ip string) (*net.Interface, error)
+	problems       []string
+}
+
+// trace Returns the path between the addresses in a network
+func (tr *tracer) trace(ctx context.Context, n *networkConfig,
+	nodes []k8s.Node, src, dst net.IP) (*trace, error) {
+	var err error
+	if tr.sh, err = newOfflineSyncHandler(n); err != nil {
+		return nil, err
+	}
+	if tr.localInterface == nil {
+		tr.localInterface = util.GetInterface
+	}
+	tr.nodes = tr.sh.networkNodes(nodes)
+	tr.problems = nil
+	t := trace{
+		Network: n.Name,
+		Src:     src.String(),
+		Dst:     dst.String(),
+		SrcNode: tr.owner(src),
+		DstNode: tr.owner(dst),
+	}
+	if t.SrcNode == "" {
+		tr.problem("No node owns %s", src)
+	}
+	if t.DstNode == "" {
+		tr.problem("No node owns %s", dst)
+	}
+	t.Hops, t.Return = []traceHop{}, []traceHop{}
+	if t.SrcNode != "" {
+		t.Hops = tr.path(ctx, t.SrcNode, dst)
+	}
+	if t.DstNode != "" {
+		t.Return = tr.path(ctx, t.DstNode, src)
+	}
+	t.Symmetric = tr.complete(t.Hops, t.DstNode) && tr.complete(t.Return, t.SrcNode)
+	if t.Symmetric && !reversed(t.Hops, t.Return) {
+		t.Symmetric = false
+		tr.problem("The return path passes other nodes")
+	}
+	t.Problems = tr.problems
+	return &t, nil
+}
+
+// problem Record a problem with the path
+func (tr *tracer) problem(format string, args ...interface{}) {
+	tr.problems = append(tr.problems, fmt.Sprintf(format, args...))
+}
+
+// complete Returns true if the path ends with local delivery on the
+// node
+func (tr *tracer) complete(hops []traceHop, node string) bool {
+	if len(hops) == 0 {
+		return false
+	}
+	last := hops[len(hops)-1]
+	return last.Node == node && last.Next == "" && last.Type == ""
+}
+
+// reversed Returns true if the hops pass the same nodes in reverse
+// order
+func reversed(hops, back []traceHop) bool {
+	if len(hops) != len(back) {
+		return false
+	}
+	for i := range hops {
+		if hops[i].Node != back[len(back)-1-i].Node {
+			return false
+		}
+	}
+	return true
+}
+
+// owner Returns the node that owns the address, or "" if no node
+// does. Overlapping POD CIDRs are resolved as by a sync; the oldest
+// node, and then by name, keeps its CIDR. Excluded CIDRs that
+// contain the address are recorded as problems
+func (tr *tracer) owner(ip net.IP) string {
+	excluded := make(map[nodeCidr]*cidrConflict)
+	conflicts := tr.sh.findConflicts(tr.nodes, "")
+	for i := range conflicts {
+		c := &conflicts[i]
+		excluded[nodeCidr{node: c.Node, cidr: c.Cidr}] = c
+	}
+	var owner string
+	for i := range tr.nodes {
+		name := tr.nodes[i].ObjectMeta.Name
+		for _, c := range tr.sh.podCidrs(&tr.nodes[i]) {
+			_, ipNet, err := net.ParseCIDR(c)
+			if err != nil || !ipNet.Contains(ip) {
+				continue
+			}
+			if x, ok := excluded[nodeCidr{node: name, cidr: ipNet.String()}]; ok {
+				tr.problem("Node %s: CIDR %s conflicts with %s of node %s",
+					name, x.Cidr, x.OtherCidr, x.Other)
+				continue
+			}
+			owner = name
+		}
+	}
+	return owner
+}
+
+// cidrOf Returns the POD CIDR of the node that contains the address,
+// or nil
+func (tr *tracer) cidrOf(node *k8s.Node, ip net.IP) *net.IPNet {
+	for _, c := range tr.sh.podCidrs(node) {
+		if _, ipNet, err := net.ParseCIDR(c); err == nil &&
+			ipNet.Contains(ip) {
+			return ipNet
+		}
+	}
+	return nil
+}
+
+// maskSize Returns the prefix length of a CIDR
+func maskSize(c *net.IPNet) int {
+	ones, _ := c.Mask.Size()
+	return ones
+}
+
+// path Follow the routes from a node to an address. The routes on
+// each node are computed as by a sync on that node
+func (tr *tracer) path(ctx context.Context, from string, dst net.IP) []traceHop {
+	hops := []traceHop{}
+	visited := make(map[string]bool)
+	for node := from; ; {
+		if visited[node] {
+			tr.problem("Routing loop at node %s to %s", node, dst)
+			return hops
+		}
+		visited[node] = true
+		n := util.FindNode(ctx, tr.nodes, node)
+		if c := tr.cidrOf(n, dst); c != nil {
+			return append(hops, traceHop{Node: node, Route: c.String()})
+		}
+		var result syncResult
+		want := tr.sh.computeRoutes(ctx, tr.nodes, node, &result)
+		r := lookupRoute(want, dst)
+		if r == nil {
+			tr.problem("No route to %s on node %s", dst, node)
+			for _, p := range result.Problems {
+				if n := util.FindNode(ctx, tr.nodes, p.Node); n != nil &&
+					tr.cidrOf(n, dst) != nil {
+					tr.problem("Node %s: %s", p.Node, p.Message)
+				}
+			}
+			return hops
+		}
+		hop := traceHop{Node: node, Route: r.Dst, Type: r.Type, Next: r.Node}
+		for _, nh := range r.NexthopList() {
+			hop.Gateways = append(hop.Gateways, nh.Gateway)
+		}
+		if node == tr.myself && len(hop.Gateways) > 0 {
+			if iface, err := tr.localInterface(hop.Gateways[0]); err == nil {
+				hop.Interface = iface.Name
+			} else {
+				tr.problem("Gateway %s is not on a local subnet", hop.Gateways[0])
+			}
+		}
+		if r.Type != "" {
+			hop.Next = ""
+			hops = append(hops, hop)
+			tr.problem("Route %s on node %s is %s", r.Dst, node, r.Type)
+			return hops
+		}
+		hops = append(hops, hop)
+		node = r.Node
+	}
+}
+
+// lookupRoute Returns the route with the longest prefix that matches
+// the address, or nil
+func lookupRoute(routes map[string]util.Route, ip net.IP) *util.Route {
+	var best *util.Route
+	bestSize := -1
+	for dst := range routes {
+		_, ipNet, err := net.ParseCIDR(dst)
+		if err != nil || !ipNet.Contains(ip) {
+			continue
+		}
+		if size := maskSize(ipNet); size > bestSize {
+			r := routes[dst]
+			best, bestSize = &r, size
+		}
+	}
+	return best
+}
+
+// printTrace Print a trace as hop lists
+func printTrace(out io.Writer, t *trace) {
+	fmt.Fprintf(out, "Network %s: %s (%s) -> %s (%s)\n",
+		t.Network, t.Src, nodeOrNone(t.SrcNode), t.Dst, nodeOrNone(t.DstNode))
+	printHops := func(title string, hops []traceHop) {
+		fmt.Fprintf(out, "  %s\n", title)
+		if len(hops) == 0 {
+			fmt.Fprintln(out, "    (none)")
+		}
+		for i, h := range hops {
+			if h.Next == "" && h.Type == "" {
+				fmt.Fprintf(out, "    %d. %s local, POD CIDR %s\n", i+1, h.Node, h.Route)
+				continue
+			}
+			line := fmt.Sprintf("    %d. %s route %s", i+1, h.Node, h.Route)
+			if h.Type != "" {
+				line += " " + h.Type
+			}
+			if len(h.Gateways) > 0 {
+				line += " via " + strings.Join(h.Gateways, ",")
+			}
+			if h.Interface != "" {
+				line += " dev " + h.Interface
+			}
+			if h.Next != "" {
+				line += " -> " + h.Next
+			}
+			fmt.Fprintln(out, line)
+		}
+	}
+	printHops("Path:", t.Hops)
+	printHops("Return:", t.Return)
+	if t.Symmetric {
+		fmt.Fprintln(out, "  Symmetric")
+	} else {
+		fmt.Fprintln(out, "  NOT symmetric")
+	}
+	for _, p := range t.Problems {
+		fmt.Fprintf(out, "  Problem: %s\n", p)
+	}
+}
+
+// nodeOrNone Returns the node name, or "no node" if it's empty
+func nodeOrNone(node string) string {
+	if node == "" {
+		return "no node"
+	}
+	return node
+}
@@ -0,0 +1,252 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkMonitor Keeps the state needed to decide if a netlink
+// notification should trig a route sync
+type netlinkMonitor struct {
+	proto netlink.RouteProtocol
+	table int
+	links map[int]*linkState // Link index -> state
+}
+
+// linkState The state of a link. Only links with global unicast
+// addresses, that are not veth's, can carry gateways or route sources
+type linkState struct {
+	seen  bool // A link update is received
+	up    bool
+	veth  bool
+	addrs map[string]bool
+}
+
+// relevant Returns true if the link may carry gateways or route
+// sources. POD veth's have only link-local addresses on the host side
+func (l *linkState) relevant() bool {
+	return !l.veth && len(l.addrs) > 0
+}
+
+// MonitorNetlink Subscribe to netlink route, link and address
+// notifications and call "trig" when routes with the protocol in the
+// table are removed or changed, when a relevant link comes back up, or
+// when a global unicast address is added to, or removed from, a link
+// that isn't a veth. So PODs that are created or deleted doesn't trig
+// syncs. Our own route updates will also trig a sync, which is
+// harmless since nothing is changed by that sync. Subscriptions are
+// renewed on errors until the context is cancelled.
+func MonitorNetlink(
+	ctx context.Context, protocol string, table int, trig func()) error {
+	proto, err := parseProtocol(protocol)
+	if err != nil {
+		return err
+	}
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	m := netlinkMonitor{
+		proto: netlink.RouteProtocol(proto),
+		table: table,
+		links: make(map[int]*linkState),
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		m.link(&netlink.LinkUpdate{
+			Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: l})
+	}
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		m.addr(&netlink.AddrUpdate{
+			LinkAddress: *a.IPNet, LinkIndex: a.LinkIndex, NewAddr: true})
+	}
+	go m.run(ctx, trig)
+	return nil
+}
+
+// run Subscribe and handle notifications until the context is
+// cancelled
+func (m *netlinkMonitor) run(ctx context.Context, trig func()) {
+	logger := logr.FromContextOrDiscard(ctx)
+	for {
+		err := m.subscribe(ctx, trig)
+		if ctx.Err() != nil {
+			return
+		}
+		// Notifications may have been lost
+		logger.Error(err, "Netlink monitor")
+		trig()
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// subscribe Subscribe and handle notifications. Returns when a
+// subscription fails or the context is cancelled
+func (m *netlinkMonitor) subscribe(ctx context.Context, trig func()) error {
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	done := make(chan struct{})
+	routeCh := make(chan netlink.RouteUpdate)
+	linkCh := make(chan netlink.LinkUpdate)
+	addrCh := make(chan netlink.AddrUpdate)
+	defer func() {
+		close(done)
+		// Drain until the subscriptions closes the channels
+		go func() {
+			for range routeCh {
+			}
+		}()
+		go func() {
+			for range linkCh {
+			}
+		}()
+		go func() {
+			for range addrCh {
+			}
+		}()
+	}()
+	errCh := make(chan error, 3)
+	errCallback := func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+	err := netlink.RouteSubscribeWithOptions(routeCh, done,
+		netlink.RouteSubscribeOptions{ErrorCallback: errCallback})
+	if err != nil {
+		return err
+	}
+	err = netlink.LinkSubscribeWithOptions(linkCh, done,
+		netlink.LinkSubscribeOptions{ErrorCallback: errCallback})
+	if err != nil {
+		return err
+	}
+	err = netlink.AddrSubscribeWithOptions(addrCh, done,
+		netlink.AddrSubscribeOptions{ErrorCallback: errCallback})
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case u, ok := <-routeCh:
+			if !ok {
+				return fmt.Errorf("Route subscription closed")
+			}
+			if m.route(&u) {
+				logger.Info("Route changed", "dst", u.Route.Dst, "type", u.Type)
+				trig()
+			}
+		case u, ok := <-linkCh:
+			if !ok {
+				return fmt.Errorf("Link subscription closed")
+			}
+			if m.link(&u) {
+				logger.Info("Link up", "name", u.Link.Attrs().Name)
+				trig()
+			}
+		case u, ok := <-addrCh:
+			if !ok {
+				return fmt.Errorf("Address subscription closed")
+			}
+			if m.addr(&u) {
+				logger.Info("Address changed", "address", u.LinkAddress.String(), "new", u.NewAddr)
+				trig()
+			}
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// route Returns true if the route update concerns a route with our
+// protocol in our table
+func (m *netlinkMonitor) route(u *netlink.RouteUpdate) bool {
+	return u.Route.Protocol == m.proto && u.Route.Table == m.table
+}
+
+// link Returns true if a relevant link has come back up. The kernel
+// removes routes via a link that goes down, so they must be restored.
+// The first update of a link only records its state
+func (m *netlinkMonitor) link(u *netlink.LinkUpdate) bool {
+	index := u.Link.Attrs().Index
+	if u.Header.Type == unix.RTM_DELLINK {
+		delete(m.links, index)
+		return false
+	}
+	l, ok := m.links[index]
+	if !ok {
+		l = &linkState{addrs: make(map[string]bool)}
+		m.links[index] = l
+	}
+	up := linkUp(u.Link)
+	wasUp := l.up
+	l.up = up
+	l.veth = u.Link.Type() == "veth"
+	if !l.seen {
+		l.seen = true
+		return false
+	}
+	return up && !wasUp && l.relevant()
+}
+
+// addr Returns true if a global unicast address is added to, or
+// removed from, a link that isn't a veth. Link-local addresses, e.g.
+// the ones the kernel adds to new POD veth's, are ignored, and so are
+// updates of existing addresses
+func (m *netlinkMonitor) addr(u *netlink.AddrUpdate) bool {
+	if !u.LinkAddress.IP.IsGlobalUnicast() {
+		return false
+	}
+	l, ok := m.links[u.LinkIndex]
+	if !ok {
+		// The link update may come later
+		l = &linkState{addrs: make(map[string]bool)}
+		m.links[u.LinkIndex] = l
+	}
+	key := u.LinkAddress.String()
+	if u.NewAddr == l.addrs[key] {
+		return false
+	}
+	if u.NewAddr {
+		l.addrs[key] = true
+	} else {
+		delete(l.addrs, key)
+	}
+	return !l.veth
+}
+
+// linkUp Returns true if the link is administratively and
+// operationally up
+func linkUp(l netlink.Link) bool {
+	attrs := l.Attrs()
+	if attrs.Flags&net.FlagUp == 0 {
+		return false
+	}
+	// Some links, e.g. dummy, has operstate "unknown"
+	return attrs.OperState == netlink.OperUp ||
+		attrs.OperState == netlink.OperUnknown
+}
@@ -0,0 +1,326 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package util
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/vishvananda/netlink"
+)
+
+// netlinkRoute A RouteHandler that uses netlink directly. No external
+// program (like "ip") is needed and no processes are forked.
+type netlinkRoute struct {
+	protocol string
+	proto    netlink.RouteProtocol
+	table    int
+}
+
+// NewNetlinkRouteHandler Create a netlink RouteHandler for the
+// specified protocol. The protocol *may* be a name defined in
+// "rt_protos", but more common a number. Routes are handled in the
+// passed routing table, 0 (zero) means the main table
+func NewNetlinkRouteHandler(
+	ctx context.Context, protocol string, table int) (RouteHandler, error) {
+	if protocol == "" {
+		return nil, fmt.Errorf("Empty protocol")
+	}
+	proto, err := parseProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+	r := netlinkRoute{
+		protocol: protocol,
+		proto:    netlink.RouteProtocol(proto),
+		table:    table,
+	}
+	return &r, nil
+}
+
+func (r *netlinkRoute) Set(ctx context.Context, route *Route) error {
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	logger.Info("Set Route", "route", route)
+	_, dst, err := net.ParseCIDR(route.Dst)
+	if err != nil {
+		return err
+	}
+	nr := netlink.Route{
+		Dst:      dst,
+		Protocol: r.proto,
+		Table:    r.table,
+		Priority: route.Metric,
+		MTU:      route.MTU,
+	}
+	if route.Src != "" {
+		if nr.Src = net.ParseIP(route.Src); nr.Src == nil {
+			return fmt.Errorf("Invalid source %s", route.Src)
+		}
+	}
+	if route.Type != "" {
+		t, ok := routeTypes[route.Type]
+		if !ok {
+			return fmt.Errorf("Invalid route type %s", route.Type)
+		}
+		nr.Type = t
+	} else if len(route.Nexthops) > 0 {
+		for _, nh := range route.Nexthops {
+			gw := net.ParseIP(nh.Gateway)
+			if gw == nil {
+				return fmt.Errorf("Invalid gateway %s", nh.Gateway)
+			}
+			// The kernel stores the weight-1 as "hops"
+			nr.MultiPath = append(nr.MultiPath, &netlink.NexthopInfo{
+				Gw:   gw,
+				Hops: nexthopWeight(nh.Weight) - 1,
+			})
+		}
+	} else {
+		if route.Gateway == "" {
+			return fmt.Errorf("No gateway")
+		}
+		if nr.Gw = net.ParseIP(route.Gateway); nr.Gw == nil {
+			return fmt.Errorf("Invalid gateway %s", route.Gateway)
+		}
+	}
+	return netlink.RouteReplace(&nr)
+}
+
+func (r *netlinkRoute) Delete(ctx context.Context, route *Route) error {
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	logger.Info("Delete Route", "route", route)
+	_, dst, err := net.ParseCIDR(route.Dst)
+	if err != nil {
+		return err
+	}
+	return netlink.RouteDel(&netlink.Route{
+		Dst:      dst,
+		Protocol: r.proto,
+		Table:    r.table,
+		Priority: route.Metric,
+	})
+}
+
+func (r *netlinkRoute) GetRoutes(ctx context.Context) ([]Route, error) {
+	routes4, err := r.list(netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	routes6, err := r.list(netlink.FAMILY_V6)
+	if err != nil {
+		return nil, err
+	}
+	return append(routes4, routes6...), nil
+}
+
+// list Returns the routes in our table with our protocol
+func (r *netlinkRoute) list(family int) ([]Route, error) {
+	filter := netlink.Route{Protocol: r.proto}
+	mask := netlink.RT_FILTER_PROTOCOL
+	if r.table != 0 {
+		filter.Table = r.table
+		mask |= netlink.RT_FILTER_TABLE
+	}
+	nlroutes, err := netlink.RouteListFiltered(family, &filter, mask)
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]Route, 0, len(nlroutes))
+	for _, nr := range nlroutes {
+		route := Route{
+			Dst:      "default",
+			Protocol: r.protocol,
+			Metric:   nr.Priority,
+			MTU:      nr.MTU,
+		}
+		if nr.Src != nil {
+			route.Src = nr.Src.String()
+		}
+		for name, t := range routeTypes {
+			if nr.Type == t {
+				route.Type = name
+			}
+		}
+		if nr.Dst != nil {
+			route.Dst = nr.Dst.String()
+		}
+		if nr.Gw != nil {
+			route.Gateway = nr.Gw.String()
+		}
+		for _, nh := range nr.MultiPath {
+			if nh.Gw == nil {
+				continue
+			}
+			route.Nexthops = append(route.Nexthops, Nexthop{
+				Gateway: nh.Gw.String(),
+				Weight:  nh.Hops + 1,
+			})
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// netlinkRule A RuleHandler that uses netlink directly
+type netlinkRule struct {
+	proto    uint8
+	table    int
+	priority int
+}
+
+func newNetlinkRuleHandler(
+	protocol string, table, priority int) (RuleHandler, error) {
+	proto, err := parseProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+	r := netlinkRule{
+		proto:    uint8(proto),
+		table:    table,
+		priority: priority,
+	}
+	return &r, nil
+}
+
+func (r *netlinkRule) Add(ctx context.Context, rule *Rule) error {
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	logger.Info("Add Rule", "rule", rule)
+	nr, err := r.netlinkRule(rule)
+	if err != nil {
+		return err
+	}
+	return netlink.RuleAdd(nr)
+}
+
+func (r *netlinkRule) Delete(ctx context.Context, rule *Rule) error {
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	logger.Info("Delete Rule", "rule", rule)
+	nr, err := r.netlinkRule(rule)
+	if err != nil {
+		return err
+	}
+	return netlink.RuleDel(nr)
+}
+
+// netlinkRule Returns a netlink rule for the passed rule
+func (r *netlinkRule) netlinkRule(rule *Rule) (*netlink.Rule, error) {
+	nr := netlink.NewRule()
+	nr.Table = r.table
+	nr.Priority = r.priority
+	nr.Protocol = r.proto
+	nr.Family = netlink.FAMILY_V6
+	if rule.Src != "" {
+		_, src, err := net.ParseCIDR(rule.Src)
+		if err != nil {
+			return nil, err
+		}
+		nr.Src = src
+		if src.IP.To4() != nil {
+			nr.Family = netlink.FAMILY_V4
+		}
+	}
+	if rule.Dst != "" {
+		_, dst, err := net.ParseCIDR(rule.Dst)
+		if err != nil {
+			return nil, err
+		}
+		nr.Dst = dst
+		if dst.IP.To4() != nil {
+			nr.Family = netlink.FAMILY_V4
+		}
+	}
+	return nr, nil
+}
+
+func (r *netlinkRule) GetRules(ctx context.Context) ([]Rule, error) {
+	var rules []Rule
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		nrules, err := netlink.RuleListFiltered(
+			family, &netlink.Rule{Table: r.table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, err
+		}
+		for _, nr := range nrules {
+			if nr.Protocol != r.proto {
+				continue
+			}
+			var rule Rule
+			if nr.Src != nil {
+				rule.Src = nr.Src.String()
+			}
+			if nr.Dst != nil {
+				rule.Dst = nr.Dst.String()
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// rtProtosFiles Files that map protocol names to numbers. The first
+// is the one used by iproute2, the second is the default location in
+// newer versions.
+var rtProtosFiles = []string{
+	"/etc/iproute2/rt_protos",
+	"/usr/share/iproute2/rt_protos",
+}
+
+// kernelProtocols Protocol names defined in "rtnetlink.h"
+var kernelProtocols = map[string]int{
+	"redirect": 1,
+	"kernel":   2,
+	"boot":     3,
+	"static":   4,
+}
+
+// parseProtocol Returns the protocol number. The protocol may be a
+// number or a name defined in "rt_protos"
+func parseProtocol(protocol string) (int, error) {
+	if p, err := strconv.Atoi(protocol); err == nil {
+		if p < 0 || p > 255 {
+			return 0, fmt.Errorf("Invalid protocol %d", p)
+		}
+		return p, nil
+	}
+	for _, f := range rtProtosFiles {
+		if p, ok := lookupProtocol(f, protocol); ok {
+			return p, nil
+		}
+	}
+	// Fallback for the names reserved by the kernel
+	if p, ok := kernelProtocols[protocol]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("Unknown protocol %s", protocol)
+}
+
+// lookupProtocol Lookup a protocol name in a "rt_protos" file
+func lookupProtocol(file, name string) (int, bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[1] == name {
+			if p, err := strconv.Atoi(fields[0]); err == nil {
+				return p, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,525 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/go-logr/logr"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Not defined in golang.org/x/sys/unix
+const (
+	// rtaNhID The route attribute for a nexthop object id
+	rtaNhID = 30
+	// sizeofNhmsg The size of "struct nhmsg"
+	sizeofNhmsg = 8
+	// sizeofNexthopGrp The size of "struct nexthop_grp"
+	sizeofNexthopGrp = 8
+)
+
+// nexthopRoute A RouteHandler that uses kernel nexthop objects. One
+// nexthop object is created per node address, and routes to the node
+// refers to it. Multipath routes refers to a nexthop group. When a
+// node address changes only the nexthop object must be updated, which
+// is atomic for all routes to the node. Nexthop objects are created
+// with the protocol, and stale objects are removed by PruneNexthops.
+//
+// The vishvananda/netlink package doesn't support nexthop objects so
+// raw netlink messages are used.
+type nexthopRoute struct {
+	netlinkRoute
+	// objects Nexthop objects with our protocol, the id is key
+	objects map[int]nexthopObject
+	// ids Our nexthop ids. The key is a string defined by the node
+	// name, the family and the index of the address
+	ids map[string]int
+}
+
+// nexthopObject A kernel nexthop object. Either gateway and link or a
+// group is defined
+type nexthopObject struct {
+	family  int
+	gateway string
+	link    int
+	group   []unix.NexthopGrp
+}
+
+// NexthopPruner Implemented by RouteHandlers that use kernel nexthop
+// objects
+type NexthopPruner interface {
+	// PruneNexthops Delete nexthop objects with our protocol that are
+	// not used by any route
+	PruneNexthops(ctx context.Context) error
+}
+
+// NewNexthopRouteHandler Create a RouteHandler that use kernel
+// nexthop objects. Otherwise the same as NewNetlinkRouteHandler
+func NewNexthopRouteHandler(
+	ctx context.Context, protocol string, table int) (RouteHandler, error) {
+	rh, err := NewNetlinkRouteHandler(ctx, protocol, table)
+	if err != nil {
+		return nil, err
+	}
+	r := nexthopRoute{
+		netlinkRoute: *(rh.(*netlinkRoute)),
+		ids:          make(map[string]int),
+	}
+	if r.objects, err = r.listNexthops(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (r *nexthopRoute) Set(ctx context.Context, route *Route) error {
+	if route.Type != "" {
+		// No next hops
+		return r.netlinkRoute.Set(ctx, route)
+	}
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	logger.Info("Set Route", "route", route)
+	_, dst, err := net.ParseCIDR(route.Dst)
+	if err != nil {
+		return err
+	}
+	family := netlink.FAMILY_V4
+	if dst.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	nexthops := route.NexthopList()
+	if len(nexthops) == 0 {
+		return fmt.Errorf("No gateway")
+	}
+	owner := route.Node
+	if owner == "" {
+		owner = route.Dst
+	}
+
+	var group []unix.NexthopGrp
+	for i, nh := range nexthops {
+		gw := net.ParseIP(nh.Gateway)
+		if gw == nil {
+			return fmt.Errorf("Invalid gateway %s", nh.Gateway)
+		}
+		link, err := gatewayLink(family, gw)
+		if err != nil {
+			return err
+		}
+		obj := nexthopObject{
+			family:  family,
+			gateway: gw.String(),
+			link:    link,
+		}
+		id := r.id(fmt.Sprintf("%s/%d/%d", owner, family, i))
+		if err := r.setNexthop(ctx, id, &obj); err != nil {
+			return err
+		}
+		group = append(group, unix.NexthopGrp{
+			Id:     uint32(id),
+			Weight: uint8(nexthopWeight(nh.Weight) - 1),
+		})
+	}
+	nhid := int(group[0].Id)
+	if len(group) > 1 {
+		nhid = r.id(fmt.Sprintf("%s/%d/group", owner, family))
+		obj := nexthopObject{
+			family: family,
+			group:  group,
+		}
+		if err := r.setNexthop(ctx, nhid, &obj); err != nil {
+			return err
+		}
+	}
+	return r.replaceRoute(family, dst, nhid, route)
+}
+
+// id Returns the nexthop id for the key. The id is derived from a
+// hash of the protocol and the key so it is the same after a restart.
+// Ids used by others are skipped.
+func (r *nexthopRoute) id(key string) int {
+	if id, ok := r.ids[key]; ok {
+		return id
+	}
+	h := fnv.New32a()
+	h.Write([]byte(r.protocol + "/" + key))
+	id := int(h.Sum32() & 0x7fffffff)
+	for {
+		if id == 0 {
+			id = 1
+		}
+		if !r.idTaken(id) {
+			break
+		}
+		id++
+	}
+	r.ids[key] = id
+	return id
+}
+
+// idTaken Returns true if the id is used by another key or by a
+// nexthop object not owned by us
+func (r *nexthopRoute) idTaken(id int) bool {
+	for _, v := range r.ids {
+		if v == id {
+			return true
+		}
+	}
+	if _, ok := r.objects[id]; ok {
+		return false // Probably ours from a previous run
+	}
+	msgs, err := nexthopRequest(unix.RTM_GETNEXTHOP, 0, id, nil)
+	return err == nil && len(msgs) > 0
+}
+
+// setNexthop Creates or replaces a nexthop object if needed
+func (r *nexthopRoute) setNexthop(
+	ctx context.Context, id int, obj *nexthopObject) error {
+	if o, ok := r.objects[id]; ok && o.equal(obj) {
+		return nil
+	}
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	logger.Info("Set Nexthop", "id", id, "gateway", obj.gateway, "group", obj.group)
+	var attrs []*nl.RtAttr
+	if len(obj.group) > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.NHA_GROUP, serializeGroup(obj.group)))
+	} else {
+		gw := net.ParseIP(obj.gateway)
+		if obj.family == netlink.FAMILY_V4 {
+			gw = gw.To4()
+		}
+		attrs = append(attrs,
+			nl.NewRtAttr(unix.NHA_GATEWAY, gw),
+			nl.NewRtAttr(unix.NHA_OIF, nl.Uint32Attr(uint32(obj.link))))
+	}
+	msg := nhmsg{Nhmsg: unix.Nhmsg{Protocol: uint8(r.proto)}}
+	if len(obj.group) == 0 {
+		// A group has no family
+		msg.Family = uint8(obj.family)
+	}
+	flags := unix.NLM_F_CREATE | unix.NLM_F_REPLACE | unix.NLM_F_ACK
+	if _, err := nexthopRequest(unix.RTM_NEWNEXTHOP, flags, id, &msg, attrs...); err != nil {
+		return err
+	}
+	r.objects[id] = *obj
+	return nil
+}
+
+// replaceRoute Replace a route that refers to a nexthop object
+func (r *nexthopRoute) replaceRoute(
+	family int, dst *net.IPNet, nhid int, route *Route) error {
+	req := nl.NewNetlinkRequest(
+		unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE|unix.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	msg.Family = uint8(family)
+	msg.Protocol = uint8(r.proto)
+	ones, _ := dst.Mask.Size()
+	msg.Dst_len = uint8(ones)
+	if r.table > 0 && r.table < 256 {
+		msg.Table = uint8(r.table)
+	} else if r.table >= 256 {
+		msg.Table = unix.RT_TABLE_UNSPEC
+	}
+	req.AddData(msg)
+	dstIP := dst.IP
+	if family == netlink.FAMILY_V4 {
+		dstIP = dstIP.To4()
+	}
+	req.AddData(nl.NewRtAttr(unix.RTA_DST, dstIP))
+	req.AddData(nl.NewRtAttr(rtaNhID, nl.Uint32Attr(uint32(nhid))))
+	if r.table >= 256 {
+		req.AddData(nl.NewRtAttr(unix.RTA_TABLE, nl.Uint32Attr(uint32(r.table))))
+	}
+	if route.Metric != 0 {
+		req.AddData(nl.NewRtAttr(unix.RTA_PRIORITY, nl.Uint32Attr(uint32(route.Metric))))
+	}
+	if route.Src != "" {
+		src := net.ParseIP(route.Src)
+		if src == nil {
+			return fmt.Errorf("Invalid source %s", route.Src)
+		}
+		if family == netlink.FAMILY_V4 {
+			src = src.To4()
+		}
+		req.AddData(nl.NewRtAttr(unix.RTA_PREFSRC, src))
+	}
+	if route.MTU != 0 {
+		metrics := nl.NewRtAttr(unix.RTA_METRICS, nil)
+		metrics.AddRtAttr(unix.RTAX_MTU, nl.Uint32Attr(uint32(route.MTU)))
+		req.AddData(metrics)
+	}
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+func (r *nexthopRoute) GetRoutes(ctx context.Context) ([]Route, error) {
+	routes, err := r.netlinkRoute.GetRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The netlink package doesn't parse the nexthop id
+	nhids, err := r.routeNexthopIds()
+	if err != nil {
+		return nil, err
+	}
+	for i := range routes {
+		routes[i].NexthopID = nhids[routes[i].Dst]
+		r.resolve(&routes[i])
+	}
+	return routes, nil
+}
+
+// resolve Set the gateway, or next hops, of a route that refers to
+// one of our nexthop objects. Without "nexthop_compat_mode" the kernel
+// doesn't include them for such routes
+func (r *nexthopRoute) resolve(route *Route) {
+	if route.NexthopID == 0 || route.Gateway != "" || len(route.Nexthops) > 0 {
+		return
+	}
+	o, ok := r.objects[route.NexthopID]
+	if !ok {
+		return
+	}
+	if len(o.group) == 0 {
+		route.Gateway = o.gateway
+		return
+	}
+	var nexthops []Nexthop
+	for _, g := range o.group {
+		m, ok := r.objects[int(g.Id)]
+		if !ok {
+			return
+		}
+		nexthops = append(nexthops, Nexthop{
+			Gateway: m.gateway,
+			Weight:  int(g.Weight) + 1,
+		})
+	}
+	route.Nexthops = nexthops
+}
+
+func (r *nexthopRoute) PruneNexthops(ctx context.Context) error {
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	objects, err := r.listNexthops()
+	if err != nil {
+		return err
+	}
+	r.objects = objects
+	nhids, err := r.routeNexthopIds()
+	if err != nil {
+		return err
+	}
+	used := make(map[int]bool)
+	for _, id := range nhids {
+		used[id] = true
+		for _, g := range r.objects[id].group {
+			used[int(g.Id)] = true
+		}
+	}
+	// Groups must be deleted before their members
+	for _, groups := range []bool{true, false} {
+		for id, o := range r.objects {
+			if used[id] || (len(o.group) > 0) != groups {
+				continue
+			}
+			logger.Info("Delete Nexthop", "id", id)
+			_, err := nexthopRequest(
+				unix.RTM_DELNEXTHOP, unix.NLM_F_ACK, id, &nhmsg{})
+			if err != nil {
+				return err
+			}
+			delete(r.objects, id)
+			for k, v := range r.ids {
+				if v == id {
+					delete(r.ids, k)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// listNexthops Returns the nexthop objects with our protocol
+func (r *nexthopRoute) listNexthops() (map[int]nexthopObject, error) {
+	msgs, err := nexthopRequest(
+		unix.RTM_GETNEXTHOP, unix.NLM_F_DUMP, 0, &nhmsg{})
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[int]nexthopObject)
+	for _, m := range msgs {
+		if len(m) < sizeofNhmsg {
+			continue
+		}
+		if m[2] != uint8(r.proto) { // nhmsg.nh_protocol
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[sizeofNhmsg:])
+		if err != nil {
+			return nil, err
+		}
+		obj := nexthopObject{family: int(m[0])}
+		id := 0
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case unix.NHA_ID:
+				id = int(nl.NativeEndian().Uint32(a.Value))
+			case unix.NHA_GATEWAY:
+				obj.gateway = net.IP(a.Value).String()
+			case unix.NHA_OIF:
+				obj.link = int(nl.NativeEndian().Uint32(a.Value))
+			case unix.NHA_GROUP:
+				obj.group = deserializeGroup(a.Value)
+			}
+		}
+		if id != 0 {
+			objects[id] = obj
+		}
+	}
+	return objects, nil
+}
+
+// routeNexthopIds Returns the nexthop ids of our routes. The
+// canonical Dst is key
+func (r *nexthopRoute) routeNexthopIds() (map[string]int, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETROUTE, unix.NLM_F_DUMP)
+	req.AddData(nl.NewRtMsg())
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWROUTE)
+	if err != nil {
+		return nil, err
+	}
+	table := r.table
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	nhids := make(map[string]int)
+	for _, m := range msgs {
+		msg := nl.DeserializeRtMsg(m)
+		if msg.Protocol != uint8(r.proto) {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+		rtable := int(msg.Table)
+		var dst net.IP
+		nhid := 0
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case unix.RTA_TABLE:
+				rtable = int(nl.NativeEndian().Uint32(a.Value))
+			case unix.RTA_DST:
+				dst = net.IP(a.Value)
+			case rtaNhID:
+				nhid = int(nl.NativeEndian().Uint32(a.Value))
+			}
+		}
+		if rtable != table || dst == nil || nhid == 0 {
+			continue
+		}
+		bits := 8 * len(dst)
+		ipNet := net.IPNet{IP: dst, Mask: net.CIDRMask(int(msg.Dst_len), bits)}
+		nhids[ipNet.String()] = nhid
+	}
+	return nhids, nil
+}
+
+// gatewayLink Returns the index of the interface with an address on
+// the same subnet as the gateway
+func gatewayLink(family int, gw net.IP) (int, error) {
+	addrs, err := netlink.AddrList(nil, family)
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range addrs {
+		if a.IPNet != nil && a.IPNet.Contains(gw) {
+			return a.LinkIndex, nil
+		}
+	}
+	return 0, fmt.Errorf("No interface found for gateway %s", gw)
+}
+
+// equal Returns true if the nexthop objects are equal
+func (o *nexthopObject) equal(other *nexthopObject) bool {
+	if o.gateway != other.gateway || o.link != other.link {
+		return false
+	}
+	if len(o.group) != len(other.group) {
+		return false
+	}
+	for i := range o.group {
+		if o.group[i].Id != other.group[i].Id ||
+			o.group[i].Weight != other.group[i].Weight {
+			return false
+		}
+	}
+	return true
+}
+
+// nexthopRequest Sends a nexthop request with an id (unless 0) and
+// the passed attributes
+func nexthopRequest(
+	proto, flags, id int, msg *nhmsg, attrs ...*nl.RtAttr) ([][]byte, error) {
+	req := nl.NewNetlinkRequest(proto, flags)
+	if msg == nil {
+		msg = &nhmsg{}
+	}
+	req.AddData(msg)
+	if id != 0 {
+		req.AddData(nl.NewRtAttr(unix.NHA_ID, nl.Uint32Attr(uint32(id))))
+	}
+	for _, a := range attrs {
+		req.AddData(a)
+	}
+	return req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWNEXTHOP)
+}
+
+// nhmsg The nexthop message header
+type nhmsg struct {
+	unix.Nhmsg
+}
+
+func (msg *nhmsg) Len() int {
+	return sizeofNhmsg
+}
+
+func (msg *nhmsg) Serialize() []byte {
+	b := make([]byte, sizeofNhmsg)
+	b[0] = msg.Family
+	b[1] = msg.Scope
+	b[2] = msg.Protocol
+	nl.NativeEndian().PutUint32(b[4:], msg.Flags)
+	return b
+}
+
+func serializeGroup(group []unix.NexthopGrp) []byte {
+	b := make([]byte, 0, len(group)*sizeofNexthopGrp)
+	for _, g := range group {
+		item := make([]byte, sizeofNexthopGrp)
+		nl.NativeEndian().PutUint32(item, g.Id)
+		item[4] = g.Weight
+		b = append(b, item...)
+	}
+	return b
+}
+
+func deserializeGroup(b []byte) []unix.NexthopGrp {
+	var group []unix.NexthopGrp
+	for len(b) >= sizeofNexthopGrp {
+		group = append(group, unix.NexthopGrp{
+			Id:     nl.NativeEndian().Uint32(b),
+			Weight: b[4],
+		})
+		b = b[sizeofNexthopGrp:]
+	}
+	return group
+}
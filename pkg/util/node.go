@@ -19,6 +19,15 @@ import (
 
 type Handler interface {
 	List() []interface{}
+	// HasSynced Returns true when the initial node list is read
+	HasSynced() bool
+}
+
+// Stopper Implemented by handlers with an informer that can be
+// stopped
+type Stopper interface {
+	// Stop Stop the informer. The handler must not be used after Stop
+	Stop()
 }
 
 type handler struct {
@@ -67,6 +76,14 @@ func (h handler) List() []interface{} {
 	return h.store.List()
 }
 
+func (h handler) Stop() {
+	close(h.stop)
+}
+
+func (h handler) HasSynced() bool {
+	return h.controller.HasSynced()
+}
+
 // Find own node.  The own node is found by comparing
 // status.nodeInfo.machineID with the "/etc/machine-id" file. The node
 // name may differ from the hostname and several nodes may have the
@@ -11,17 +11,51 @@ import (
 	"fmt"
 	"net"
 	"os/exec"
+	"strconv"
 	"time"
 
 	"github.com/go-logr/logr"
+	"golang.org/x/sys/unix"
 )
 
 // Route Defines a route. The json format is a narroved version of the
-// "ip -j" command
+// "ip -j" command. A route has either a Gateway or, for multipath
+// (ECMP) routes, a list of Nexthops. Src (preferred source), Metric
+// and MTU are optional. Node is the name of the K8s node the route
+// leads to and is not a kernel attribute. NexthopID is set for routes
+// that refers to a kernel nexthop object, and is not compared by
+// RoutesEqual. Type is "blackhole" or "unreachable" for routes
+// without next hops, and empty for normal (unicast) routes
 type Route struct {
-	Dst      string `json:"dst"`
-	Protocol string `json:"protocol"`
-	Gateway  string `json:"gateway"`
+	Type      string    `json:"type,omitempty"`
+	Dst       string    `json:"dst"`
+	Protocol  string    `json:"protocol"`
+	Gateway   string    `json:"gateway"`
+	Nexthops  []Nexthop `json:"nexthops,omitempty"`
+	Src       string    `json:"prefsrc,omitempty"`
+	Metric    int       `json:"metric,omitempty"`
+	MTU       int       `json:"mtu,omitempty"`
+	Node      string    `json:"node,omitempty"`
+	NexthopID int       `json:"nhid,omitempty"`
+}
+
+// Nexthop A next hop in a multipath route. A Weight of 0 (zero) is
+// the same as 1 (one), which is the kernel default
+type Nexthop struct {
+	Gateway string `json:"gateway"`
+	Weight  int    `json:"weight,omitempty"`
+}
+
+// NexthopList Returns the next hops of the route. For a route with a
+// single Gateway, a list with one item is returned
+func (r *Route) NexthopList() []Nexthop {
+	if len(r.Nexthops) > 0 {
+		return r.Nexthops
+	}
+	if r.Gateway == "" {
+		return nil
+	}
+	return []Nexthop{{Gateway: r.Gateway}}
 }
 
 type RouteHandler interface {
@@ -35,6 +69,7 @@ type RouteHandler interface {
 
 type ipRoute struct {
 	protocol string
+	table    int
 	ip       string
 }
 
@@ -59,17 +94,116 @@ func RoutesEqual(r1, r2 *Route) bool {
 	if dst1.String() != dst2.String() {
 		return false
 	}
-	gw1 := net.ParseIP(r1.Gateway)
-	if gw1 == nil {
+	if r1.MTU != r2.MTU {
+		return false
+	}
+	if r1.EffectiveMetric() != r2.EffectiveMetric() {
+		return false
+	}
+	if !addressEqual(r1.Src, r2.Src) {
 		return false
 	}
-	return gw1.Equal(net.ParseIP(r2.Gateway))
+	if r1.Type != r2.Type {
+		return false
+	}
+	if r1.Type != "" {
+		return true // No next hops
+	}
+	return nexthopsEqual(r1.NexthopList(), r2.NexthopList())
+}
+
+// routeTypes The supported route types without next hops
+var routeTypes = map[string]int{
+	"blackhole":   unix.RTN_BLACKHOLE,
+	"unreachable": unix.RTN_UNREACHABLE,
+}
+
+// ValidRouteType Returns true if the type is empty (unicast) or a
+// supported route type without next hops
+func ValidRouteType(t string) bool {
+	_, ok := routeTypes[t]
+	return ok || t == ""
+}
+
+// EffectiveMetric Returns the metric used by the kernel. The default
+// is 1024 for IPv6 routes. The metric is a part of the route key, so
+// a route with another metric is not replaced but added
+func (r *Route) EffectiveMetric() int {
+	if r.Metric == 0 && family(r.Dst) == "-6" {
+		return 1024
+	}
+	return r.Metric
+}
+
+// addressEqual Returns true if the addresses are equal or both empty
+func addressEqual(a1, a2 string) bool {
+	if a1 == "" || a2 == "" {
+		return a1 == a2
+	}
+	return net.ParseIP(a1).Equal(net.ParseIP(a2))
 }
 
-// NewRouteHandler Create a RouteHandler for the specified protocol.
-// The protocol *may* be a name, but more common a number
+// nexthopsEqual Returns true if the next hops are equal. The order is
+// not significant since the kernel may re-order next hops
+func nexthopsEqual(nh1, nh2 []Nexthop) bool {
+	if len(nh1) == 0 || len(nh1) != len(nh2) {
+		return false
+	}
+	weights := make(map[string]int, len(nh1))
+	for _, nh := range nh1 {
+		gw := net.ParseIP(nh.Gateway)
+		if gw == nil {
+			return false
+		}
+		weights[gw.String()] = nexthopWeight(nh.Weight)
+	}
+	for _, nh := range nh2 {
+		gw := net.ParseIP(nh.Gateway)
+		if gw == nil {
+			return false
+		}
+		if w, ok := weights[gw.String()]; !ok || w != nexthopWeight(nh.Weight) {
+			return false
+		}
+	}
+	return true
+}
+
+// MaxNexthopWeight The kernel stores "weight - 1" in 8 bits
+const MaxNexthopWeight = 256
+
+// nexthopWeight Returns the effective weight
+func nexthopWeight(weight int) int {
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+// NewRouteHandler Create a RouteHandler for the specified protocol
+// using the named backend. The backend is "netlink" (default),
+// "nexthop" or "ip". The "nexthop" backend uses netlink and kernel
+// nexthop objects. The "ip" backend execs the "ip" program from
+// iproute2 and is kept as a fallback. Routes are handled in the
+// passed routing table, 0 (zero) means the main table.
 func NewRouteHandler(
-	ctx context.Context, protocol string) (RouteHandler, error) {
+	ctx context.Context, backend, protocol string, table int) (RouteHandler, error) {
+	switch backend {
+	case "", "netlink":
+		return NewNetlinkRouteHandler(ctx, protocol, table)
+	case "nexthop":
+		return NewNexthopRouteHandler(ctx, protocol, table)
+	case "ip":
+		return NewIpRouteHandler(ctx, protocol, table)
+	}
+	return nil, fmt.Errorf("Unknown route handler backend %s", backend)
+}
+
+// NewIpRouteHandler Create a RouteHandler for the specified protocol
+// that uses the "ip" program. The protocol *may* be a name, but more
+// common a number
+func NewIpRouteHandler(
+	ctx context.Context, protocol string, table int) (RouteHandler, error) {
 	if protocol == "" {
 		return nil, fmt.Errorf("Empty protocol")
 	}
@@ -79,6 +213,7 @@ func NewRouteHandler(
 	}
 	r := ipRoute{
 		protocol: protocol,
+		table:    table,
 		ip:       ipPath,
 	}
 	return &r, nil
@@ -96,14 +231,33 @@ func family(cidr string) string {
 func (r *ipRoute) Set(ctx context.Context, route *Route) error {
 	logger := logr.FromContextOrDiscard(ctx).V(1)
 	logger.Info("Set Route", "route", route)
-	if route.Gateway == "" {
-		return fmt.Errorf("No gateway")
+	args := []string{
+		family(route.Dst), "-j", "route", "replace", "protocol", r.protocol}
+	if route.Type != "" {
+		if !ValidRouteType(route.Type) {
+			return fmt.Errorf("Invalid route type %s", route.Type)
+		}
+		args = append(args, route.Type)
 	}
+	args = append(args, route.Dst)
+	args = append(args, tableArgs(r.table)...)
+	if route.Type != "" {
+		// No next hops
+	} else if len(route.Nexthops) > 0 {
+		for _, nh := range route.Nexthops {
+			args = append(args, "nexthop", "via", nh.Gateway,
+				"weight", strconv.Itoa(nexthopWeight(nh.Weight)))
+		}
+	} else {
+		if route.Gateway == "" {
+			return fmt.Errorf("No gateway")
+		}
+		args = append(args, "via", route.Gateway)
+	}
+	args = append(args, routeAttributes(route)...)
 	toctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
-	cmd := exec.CommandContext(
-		toctx, r.ip, family(route.Dst), "-j", "route", "replace",
-		"protocol", r.protocol, route.Dst, "via", route.Gateway)
+	cmd := exec.CommandContext(toctx, r.ip, args...)
 	return cmd.Run()
 }
 
@@ -112,12 +266,41 @@ func (r *ipRoute) Delete(ctx context.Context, route *Route) error {
 	logger.Info("Delete Route", "route", route)
 	toctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
-	cmd := exec.CommandContext(
-		toctx, r.ip, family(route.Dst), "-j", "route", "del",
-		"protocol", r.protocol, route.Dst)
+	args := []string{
+		family(route.Dst), "-j", "route", "del",
+		"protocol", r.protocol, route.Dst}
+	args = append(args, tableArgs(r.table)...)
+	if route.Metric != 0 {
+		args = append(args, "metric", strconv.Itoa(route.Metric))
+	}
+	cmd := exec.CommandContext(toctx, r.ip, args...)
 	return cmd.Run()
 }
 
+// tableArgs Returns "ip" arguments for a routing table. Nothing is
+// returned for the main table
+func tableArgs(table int) []string {
+	if table == 0 {
+		return nil
+	}
+	return []string{"table", strconv.Itoa(table)}
+}
+
+// routeAttributes Returns "ip route" arguments for optional attributes
+func routeAttributes(route *Route) []string {
+	var args []string
+	if route.Src != "" {
+		args = append(args, "src", route.Src)
+	}
+	if route.Metric != 0 {
+		args = append(args, "metric", strconv.Itoa(route.Metric))
+	}
+	if route.MTU != 0 {
+		args = append(args, "mtu", strconv.Itoa(route.MTU))
+	}
+	return args
+}
+
 func (r *ipRoute) GetRoutes(ctx context.Context) ([]Route, error) {
 	toctx, cancel := context.WithTimeout(ctx, time.Second*8)
 	defer cancel()
@@ -136,8 +319,9 @@ func (r *ipRoute) GetRoutes(ctx context.Context) ([]Route, error) {
 }
 
 func (r *ipRoute) execIp(ctx context.Context, family string) ([]Route, error) {
-	cmd := exec.CommandContext(
-		ctx, r.ip, family, "-j", "route", "show", "protocol", r.protocol)
+	args := []string{family, "-j", "route", "show", "protocol", r.protocol}
+	args = append(args, tableArgs(r.table)...)
+	cmd := exec.CommandContext(ctx, r.ip, args...)
 	out, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -146,8 +330,22 @@ func (r *ipRoute) execIp(ctx context.Context, family string) ([]Route, error) {
 	if err = json.Unmarshal(out, &routes); err != nil {
 		return nil, err
 	}
+	// The MTU is not a top-level item but is in the "metrics" array
+	metrics := []struct {
+		Metrics []struct {
+			MTU int `json:"mtu"`
+		} `json:"metrics"`
+	}{}
+	if err = json.Unmarshal(out, &metrics); err != nil {
+		return nil, err
+	}
 	for i := range routes {
 		routes[i].Protocol = r.protocol // When requesting a protocol the field is suspressed
+		for _, m := range metrics[i].Metrics {
+			if m.MTU != 0 {
+				routes[i].MTU = m.MTU
+			}
+		}
 	}
 	return routes, nil
 }
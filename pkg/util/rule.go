@@ -0,0 +1,188 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Rule Defines a policy routing rule that directs traffic from Src
+// or to Dst to the routing table of the RuleHandler. Src and Dst are
+// CIDRs and one of them is empty.
+type Rule struct {
+	Src string `json:"src,omitempty"`
+	Dst string `json:"dst,omitempty"`
+}
+
+type RuleHandler interface {
+	// Add Add a rule
+	Add(ctx context.Context, rule *Rule) error
+	// Delete Delete a rule
+	Delete(ctx context.Context, rule *Rule) error
+	// GetRules Returns current rules
+	GetRules(ctx context.Context) ([]Rule, error)
+}
+
+// RulesEqual Returns true if the rules are equal
+func RulesEqual(r1, r2 *Rule) bool {
+	if r1 == nil || r2 == nil {
+		return (r1 == nil) == (r2 == nil)
+	}
+	return canonicalCidr(r1.Src) == canonicalCidr(r2.Src) &&
+		canonicalCidr(r1.Dst) == canonicalCidr(r2.Dst)
+}
+
+// canonicalCidr Returns the CIDR in canonical form, or the passed
+// string if it can't be parsed
+func canonicalCidr(c string) string {
+	if _, ipNet, err := net.ParseCIDR(c); err == nil {
+		return ipNet.String()
+	}
+	return c
+}
+
+// NewRuleHandler Create a RuleHandler for the specified protocol
+// using the named backend, "netlink" (default), "nexthop" (same as
+// netlink) or "ip". Rules are
+// added with the passed priority and directs traffic to the passed
+// table. Only rules for the table with the protocol are handled.
+func NewRuleHandler(
+	ctx context.Context, backend, protocol string, table, priority int) (RuleHandler, error) {
+	if protocol == "" {
+		return nil, fmt.Errorf("Empty protocol")
+	}
+	if table == 0 {
+		return nil, fmt.Errorf("No table")
+	}
+	switch backend {
+	case "", "netlink", "nexthop":
+		return newNetlinkRuleHandler(protocol, table, priority)
+	case "ip":
+		ipPath, err := exec.LookPath("ip")
+		if err != nil {
+			return nil, err
+		}
+		r := ipRule{
+			protocol: protocol,
+			table:    table,
+			priority: priority,
+			ip:       ipPath,
+		}
+		return &r, nil
+	}
+	return nil, fmt.Errorf("Unknown rule handler backend %s", backend)
+}
+
+type ipRule struct {
+	protocol string
+	table    int
+	priority int
+	ip       string
+}
+
+func (r *ipRule) Add(ctx context.Context, rule *Rule) error {
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	logger.Info("Add Rule", "rule", rule)
+	return r.exec(ctx, "add", rule)
+}
+
+func (r *ipRule) Delete(ctx context.Context, rule *Rule) error {
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	logger.Info("Delete Rule", "rule", rule)
+	return r.exec(ctx, "del", rule)
+}
+
+func (r *ipRule) exec(ctx context.Context, op string, rule *Rule) error {
+	toctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	args := []string{ruleFamily(rule), "rule", op}
+	if rule.Src != "" {
+		args = append(args, "from", rule.Src)
+	}
+	if rule.Dst != "" {
+		args = append(args, "to", rule.Dst)
+	}
+	args = append(args,
+		"priority", strconv.Itoa(r.priority),
+		"protocol", r.protocol,
+		"table", strconv.Itoa(r.table))
+	cmd := exec.CommandContext(toctx, r.ip, args...)
+	return cmd.Run()
+}
+
+func (r *ipRule) GetRules(ctx context.Context) ([]Rule, error) {
+	toctx, cancel := context.WithTimeout(ctx, time.Second*8)
+	defer cancel()
+	rules4, err := r.execIp(toctx, "-4")
+	if err != nil {
+		return nil, err
+	}
+	rules6, err := r.execIp(toctx, "-6")
+	if err != nil {
+		return nil, err
+	}
+	return append(rules4, rules6...), nil
+}
+
+func (r *ipRule) execIp(ctx context.Context, family string) ([]Rule, error) {
+	cmd := exec.CommandContext(
+		ctx, r.ip, family, "-j", "rule", "show",
+		"protocol", r.protocol, "table", strconv.Itoa(r.table))
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	// The prefix length is a separate item in "ip -j rule"
+	items := []struct {
+		Src    string `json:"src"`
+		SrcLen int    `json:"srclen"`
+		Dst    string `json:"dst"`
+		DstLen int    `json:"dstlen"`
+	}{}
+	if err = json.Unmarshal(out, &items); err != nil {
+		return nil, err
+	}
+	rules := make([]Rule, 0, len(items))
+	for _, i := range items {
+		var rule Rule
+		if i.Src != "" && i.Src != "all" {
+			rule.Src = prefix(i.Src, i.SrcLen)
+		}
+		if i.Dst != "" && i.Dst != "all" {
+			rule.Dst = prefix(i.Dst, i.DstLen)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// prefix Returns a CIDR. The length is omitted by "ip" for host
+// addresses
+func prefix(adr string, length int) string {
+	if length == 0 {
+		if ip := net.ParseIP(adr); ip != nil && ip.To4() != nil {
+			return adr + "/32"
+		}
+		return adr + "/128"
+	}
+	return fmt.Sprintf("%s/%d", adr, length)
+}
+
+// ruleFamily Returns the "ip" family option for a rule
+func ruleFamily(rule *Rule) string {
+	if rule.Src != "" {
+		return family(rule.Src)
+	}
+	return family(rule.Dst)
+}
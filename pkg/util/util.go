@@ -1,11 +1,14 @@
 package util
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -20,6 +23,16 @@ import (
 // GetClientset Returns a Kubernetes Clientset. Works inside PODs as well
 // as outside
 func GetClientset() (*kubernetes.Clientset, error) {
+	config, err := GetRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// GetRestConfig Returns the in-cluster config, or the config from the
+// default kubeconfig file
+func GetRestConfig() (*rest.Config, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		kubeconfig :=
@@ -29,7 +42,7 @@ func GetClientset() (*kubernetes.Clientset, error) {
 			return nil, err
 		}
 	}
-	return kubernetes.NewForConfig(config)
+	return config, nil
 }
 func GetApi(ctx context.Context) core.CoreV1Interface {
 	clientset, err := GetClientset()
@@ -94,6 +107,49 @@ func CreateCIDR(doubleDashCIDR string, nodeNo uint) (string, error) {
 	return fmt.Sprintf("%s/%d", ipNet.IP.String(), bits2), nil
 }
 
+// CIDRNumber Returns the node number of a CIDR created from a
+// "double-dash" CIDR. This is the reverse of CreateCIDR. An error is
+// returned if the CIDR is not a per-node CIDR within the double-dash
+// CIDR
+func CIDRNumber(doubleDashCIDR, cidr string) (uint, error) {
+	citems := strings.Split(doubleDashCIDR, "/")
+	if len(citems) != 3 {
+		return 0, fmt.Errorf("Invalid DoubleDashCIDR %s", doubleDashCIDR)
+	}
+	_, base, err := net.ParseCIDR(strings.Join(citems[0:2], "/"))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse CIDR")
+	}
+	bits2, err := strconv.Atoi(citems[2])
+	if err != nil {
+		return 0, fmt.Errorf("Bits2 invalid %s", citems[2])
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0, err
+	}
+	if ones, _ := ipNet.Mask.Size(); ones != bits2 {
+		return 0, fmt.Errorf("Prefix length of %s is not %d", cidr, bits2)
+	}
+	if (base.IP.To4() == nil) != (ipNet.IP.To4() == nil) ||
+		!base.Contains(ipNet.IP) {
+		return 0, fmt.Errorf("%s is not within %s", cidr, doubleDashCIDR)
+	}
+	_, size := ipNet.Mask.Size()
+	offset := new(big.Int).Sub(
+		new(big.Int).SetBytes(ipNet.IP), new(big.Int).SetBytes(base.IP))
+	offset.Rsh(offset, uint(size-bits2))
+	if !offset.IsUint64() || offset.Uint64() > uint64(^uint(0)) {
+		return 0, fmt.Errorf("Node number too large")
+	}
+	nodeNo := uint(offset.Uint64())
+	// Verify, e.g. that the CIDR is within the node-field
+	if c, err := CreateCIDR(doubleDashCIDR, nodeNo); err != nil || c != ipNet.String() {
+		return 0, fmt.Errorf("%s is not a node CIDR in %s", cidr, doubleDashCIDR)
+	}
+	return nodeNo, nil
+}
+
 // shiftOr Shift the number left and OR it with the bytes.
 func shiftOr(b []byte, n uint64, shift int) {
 	// 1. Shift the number by the fraction of 8
@@ -115,18 +171,28 @@ func shiftOr(b []byte, n uint64, shift int) {
 
 // GetMTU Find the interface for the passed IP and return it's MTU
 func GetMTU(ip string) (int, error) {
+	iface, err := GetInterface(ip)
+	if err != nil {
+		return 1500, err
+	}
+	return iface.MTU, nil
+}
+
+// GetInterface Returns the interface with an address on the same
+// subnet as the passed IP
+func GetInterface(ip string) (*net.Interface, error) {
 	adr := net.ParseIP(ip)
 	if adr == nil {
-		return 1500, fmt.Errorf("Invalid IP %s", ip)
+		return nil, fmt.Errorf("Invalid IP %s", ip)
 	}
 
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return 1500, err
+		return nil, err
 	}
 
-	for _, iface := range ifaces {
-		addrs, err := iface.Addrs()
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
 		if err != nil {
 			continue
 		}
@@ -136,9 +202,96 @@ func GetMTU(ip string) (int, error) {
 				continue
 			}
 			if n.Contains(adr) {
-				return iface.MTU, nil
+				return &ifaces[i], nil
 			}
 		}
 	}
-	return 1500, fmt.Errorf("MTU not found for %s", ip)
+	return nil, fmt.Errorf("No interface found for %s", ip)
+}
+
+// GetLocalAddress Returns a local address on the same subnet as the
+// passed IP. This is used as preferred source for routes via the IP
+func GetLocalAddress(ip string) (string, error) {
+	adr := net.ParseIP(ip)
+	if adr == nil {
+		return "", fmt.Errorf("Invalid IP %s", ip)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		local, n, err := net.ParseCIDR(a.String())
+		if err != nil {
+			continue
+		}
+		if n.Contains(adr) {
+			return local.String(), nil
+		}
+	}
+	return "", fmt.Errorf("No local address found for %s", ip)
+}
+
+// GetInterfaceAddresses Returns the global unicast addresses on the
+// named interface, or on all interfaces if the name is empty. If
+// subnets (CIDRs) are passed, only addresses within them are
+// returned. IPv4 addresses are returned first, and the order is
+// stable
+func GetInterfaceAddresses(iface string, subnets []string) ([]string, error) {
+	var nets []*net.IPNet
+	for _, s := range subnets {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	var addrs []net.Addr
+	if iface != "" {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, err
+		}
+		if addrs, err = i.Addrs(); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if addrs, err = net.InterfaceAddrs(); err != nil {
+			return nil, err
+		}
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		ip, _, err := net.ParseCIDR(a.String())
+		if err != nil || !ip.IsGlobalUnicast() {
+			continue
+		}
+		if len(nets) > 0 && !containsIP(nets, ip) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		if (ips[i].To4() == nil) != (ips[j].To4() == nil) {
+			return ips[i].To4() != nil
+		}
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+	result := make([]string, len(ips))
+	for i, ip := range ips {
+		result[i] = ip.String()
+	}
+	return result, nil
+}
+
+// containsIP Returns true if any of the subnets contains the IP
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, n := range subnets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
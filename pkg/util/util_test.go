@@ -2,7 +2,12 @@ package util
 
 import (
 	"bytes"
+	"net"
+	"reflect"
 	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	//"net"
 )
 
@@ -84,6 +89,67 @@ func TestCreateCIDR(t *testing.T) {
 	}
 }
 
+func TestCIDRNumber(t *testing.T) {
+	tcases := []struct {
+		name        string
+		dcidr       string
+		cidr        string
+		expected    uint
+		expectedErr bool
+	}{
+		{
+			name:     "Basic IPv6",
+			dcidr:    "fd00:1000::/96/112",
+			cidr:     "fd00:1000::5:0/112",
+			expected: 5,
+		},
+		{
+			name:     "Basic IPv4",
+			dcidr:    "192.168.0.0/22/25",
+			cidr:     "192.168.2.128/25",
+			expected: 5,
+		},
+		{
+			name:     "First IPv6/64",
+			dcidr:    "fd00:1000::/48/64",
+			cidr:     "fd00:1000::/64",
+			expected: 0,
+		},
+		{
+			name:        "Wrong prefix length",
+			dcidr:       "192.168.0.0/22/25",
+			cidr:        "192.168.2.0/24",
+			expectedErr: true,
+		},
+		{
+			name:        "Outside",
+			dcidr:       "192.168.0.0/22/25",
+			cidr:        "192.168.4.0/25",
+			expectedErr: true,
+		},
+		{
+			name:        "Wrong family",
+			dcidr:       "fd00:1000::/96/112",
+			cidr:        "192.168.4.0/24",
+			expectedErr: true,
+		},
+	}
+	for _, tc := range tcases {
+		n, err := CIDRNumber(tc.dcidr, tc.cidr)
+		if tc.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected err, got %d", tc.name, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected err %v", tc.name, err)
+		} else if n != tc.expected {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.expected, n)
+		}
+	}
+}
+
 func TestShiftOr(t *testing.T) {
 	tcases := []struct {
 		name     string
@@ -168,6 +234,134 @@ func TestRouteEqual(t *testing.T) {
 			},
 			equal: true,
 		},
+		{
+			name: "Multipath, different order",
+			r1: &Route{
+				Dst: "10.0.0.0/24",
+				Nexthops: []Nexthop{
+					{Gateway: "192.168.1.1", Weight: 1},
+					{Gateway: "192.168.2.1", Weight: 2},
+				},
+			},
+			r2: &Route{
+				Dst: "10.0.0.0/24",
+				Nexthops: []Nexthop{
+					{Gateway: "192.168.2.1", Weight: 2},
+					{Gateway: "192.168.1.1"},
+				},
+			},
+			equal: true,
+		},
+		{
+			name: "Multipath, different weight",
+			r1: &Route{
+				Dst: "10.0.0.0/24",
+				Nexthops: []Nexthop{
+					{Gateway: "192.168.1.1"},
+					{Gateway: "192.168.2.1", Weight: 2},
+				},
+			},
+			r2: &Route{
+				Dst: "10.0.0.0/24",
+				Nexthops: []Nexthop{
+					{Gateway: "192.168.1.1"},
+					{Gateway: "192.168.2.1"},
+				},
+			},
+			equal: false,
+		},
+		{
+			name: "Multipath and single gateway",
+			r1: &Route{
+				Dst: "10.0.0.0/24",
+				Nexthops: []Nexthop{
+					{Gateway: "192.168.1.1"},
+					{Gateway: "192.168.2.1"},
+				},
+			},
+			r2: &Route{
+				Dst:     "10.0.0.0/24",
+				Gateway: "192.168.1.1",
+			},
+			equal: false,
+		},
+		{
+			name: "Default IPv6 metric",
+			r1: &Route{
+				Dst:     "fd00::/120",
+				Gateway: "fd00:1::1",
+			},
+			r2: &Route{
+				Dst:     "fd00::/120",
+				Gateway: "fd00:1::1",
+				Metric:  1024,
+			},
+			equal: true,
+		},
+		{
+			name: "Different metric",
+			r1: &Route{
+				Dst:     "10.0.0.0/24",
+				Gateway: "192.168.1.1",
+				Metric:  100,
+			},
+			r2: &Route{
+				Dst:     "10.0.0.0/24",
+				Gateway: "192.168.1.1",
+			},
+			equal: false,
+		},
+		{
+			name: "Different src",
+			r1: &Route{
+				Dst:     "10.0.0.0/24",
+				Gateway: "192.168.1.1",
+				Src:     "192.168.1.2",
+			},
+			r2: &Route{
+				Dst:     "10.0.0.0/24",
+				Gateway: "192.168.1.1",
+			},
+			equal: false,
+		},
+		{
+			name: "Different MTU",
+			r1: &Route{
+				Dst:     "10.0.0.0/24",
+				Gateway: "192.168.1.1",
+				MTU:     1400,
+			},
+			r2: &Route{
+				Dst:     "10.0.0.0/24",
+				Gateway: "192.168.1.1",
+				MTU:     1500,
+			},
+			equal: false,
+		},
+		{
+			name: "Blackhole routes",
+			r1: &Route{
+				Type: "blackhole",
+				Dst:  "10.0.0.0/24",
+			},
+			r2: &Route{
+				Type: "blackhole",
+				Dst:  "10.0.0.0/24",
+			},
+			equal: true,
+		},
+		{
+			name: "Different type",
+			r1: &Route{
+				Type: "blackhole",
+				Dst:  "10.0.0.0/24",
+			},
+			r2: &Route{
+				Type: "unreachable",
+				Dst:  "10.0.0.0/24",
+			},
+			equal: false,
+		},
 	}
 	for _, tc := range tcases {
 		if RoutesEqual(tc.r1, tc.r2) != tc.equal {
@@ -175,3 +369,213 @@ func TestRouteEqual(t *testing.T) {
 		}
 	}
 }
+
+func TestParseProtocol(t *testing.T) {
+	tcases := []struct {
+		name        string
+		protocol    string
+		expected    int
+		expectedErr bool
+	}{
+		{
+			name:     "Number",
+			protocol: "202",
+			expected: 202,
+		},
+		{
+			name:     "Kernel name",
+			protocol: "kernel",
+			expected: 2,
+		},
+		{
+			name:        "Too large",
+			protocol:    "256",
+			expectedErr: true,
+		},
+		{
+			name:        "Unknown name",
+			protocol:    "no-such-protocol",
+			expectedErr: true,
+		},
+	}
+	for _, tc := range tcases {
+		p, err := parseProtocol(tc.protocol)
+		if tc.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected err, got %d", tc.name, p)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%s: unexpected err %v", tc.name, err)
+			} else if p != tc.expected {
+				t.Errorf("%s: expected %d, got %d", tc.name, tc.expected, p)
+			}
+		}
+	}
+}
+
+func TestVrfTable(t *testing.T) {
+	// The loopback interface exists in any network namespace
+	if _, err := VrfTable("lo"); err == nil || err.Error() != "Not a VRF lo" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err := VrfTable("no-such-vrf"); err == nil {
+		t.Errorf("No error for a missing VRF")
+	}
+}
+
+func TestNexthopGroup(t *testing.T) {
+	group := []unix.NexthopGrp{
+		{Id: 1},
+		{Id: 0x12345678, Weight: 2},
+	}
+	b := serializeGroup(group)
+	if len(b) != 2*sizeofNexthopGrp {
+		t.Fatalf("Invalid length %d", len(b))
+	}
+	o1 := nexthopObject{group: group}
+	o2 := nexthopObject{group: deserializeGroup(b)}
+	if !o1.equal(&o2) {
+		t.Errorf("Expected %v, got %v", o1.group, o2.group)
+	}
+	o2.group[1].Weight = 0
+	if o1.equal(&o2) {
+		t.Errorf("Weight not compared")
+	}
+}
+
+func TestNexthopResolve(t *testing.T) {
+	r := nexthopRoute{objects: map[int]nexthopObject{
+		1: {family: 2, gateway: "192.168.1.1"},
+		2: {family: 2, gateway: "192.168.2.1"},
+		3: {group: []unix.NexthopGrp{{Id: 1}, {Id: 2, Weight: 2}}},
+	}}
+	tcases := []struct {
+		route    Route
+		expected Route
+	}{
+		{
+			route:    Route{Dst: "10.0.0.0/24", NexthopID: 1},
+			expected: Route{Dst: "10.0.0.0/24", NexthopID: 1, Gateway: "192.168.1.1"},
+		},
+		{
+			route: Route{Dst: "10.0.0.0/24", NexthopID: 3},
+			expected: Route{Dst: "10.0.0.0/24", NexthopID: 3, Nexthops: []Nexthop{
+				{Gateway: "192.168.1.1", Weight: 1}, {Gateway: "192.168.2.1", Weight: 3}}},
+		},
+		{
+			// Not our object
+			route:    Route{Dst: "10.0.0.0/24", NexthopID: 4},
+			expected: Route{Dst: "10.0.0.0/24", NexthopID: 4},
+		},
+		{
+			// In "nexthop_compat_mode" the gateway is included
+			route:    Route{Dst: "10.0.0.0/24", NexthopID: 3, Gateway: "192.168.1.1"},
+			expected: Route{Dst: "10.0.0.0/24", NexthopID: 3, Gateway: "192.168.1.1"},
+		},
+	}
+	for _, tc := range tcases {
+		route := tc.route
+		r.resolve(&route)
+		if !reflect.DeepEqual(route, tc.expected) {
+			t.Errorf("Expected %v, got %v", tc.expected, route)
+		}
+	}
+}
+
+func TestNetlinkMonitor(t *testing.T) {
+	m := netlinkMonitor{
+		proto: 202,
+		table: unix.RT_TABLE_MAIN,
+		links: make(map[int]*linkState),
+	}
+	routes := []struct {
+		proto netlink.RouteProtocol
+		table int
+		trig  bool
+	}{
+		{proto: 202, table: unix.RT_TABLE_MAIN, trig: true},
+		{proto: 202, table: 10},
+		{proto: unix.RTPROT_KERNEL, table: unix.RT_TABLE_MAIN},
+	}
+	for _, r := range routes {
+		u := netlink.RouteUpdate{
+			Route: netlink.Route{Protocol: r.proto, Table: r.table}}
+		if m.route(&u) != r.trig {
+			t.Errorf("Route %d/%d: expected %v", r.proto, r.table, r.trig)
+		}
+	}
+
+	// Link 1 and 2 has global addresses, link 3 is a new POD veth
+	type linkEvent struct {
+		index int
+		veth  bool
+		up    bool
+		del   bool
+	}
+	type addrEvent struct {
+		index int
+		cidr  string
+		del   bool
+	}
+	events := []struct {
+		link *linkEvent
+		addr *addrEvent
+		trig bool
+	}{
+		{link: &linkEvent{index: 1, up: true}},
+		{link: &linkEvent{index: 2}},
+		{addr: &addrEvent{index: 1, cidr: "192.168.1.1/24"}, trig: true},
+		{addr: &addrEvent{index: 1, cidr: "192.168.1.1/24"}},
+		{addr: &addrEvent{index: 2, cidr: "fd00:2::1/64"}, trig: true},
+		{link: &linkEvent{index: 1, up: true}},
+		{link: &linkEvent{index: 2, up: true}, trig: true},
+		{link: &linkEvent{index: 2, up: true}},
+		{link: &linkEvent{index: 2}},
+		{link: &linkEvent{index: 2, up: true}, trig: true},
+		// A new POD veth
+		{link: &linkEvent{index: 3, veth: true}},
+		{addr: &addrEvent{index: 3, cidr: "fe80::1/64"}},
+		{link: &linkEvent{index: 3, veth: true, up: true}},
+		{link: &linkEvent{index: 3, veth: true}},
+		{link: &linkEvent{index: 3, veth: true, up: true}},
+		{addr: &addrEvent{index: 3, cidr: "fe80::1/64", del: true}},
+		{link: &linkEvent{index: 3, veth: true, del: true}},
+		// An address before the first link update
+		{addr: &addrEvent{index: 4, cidr: "10.0.0.1/24"}, trig: true},
+		{link: &linkEvent{index: 4, up: true}},
+		{addr: &addrEvent{index: 1, cidr: "192.168.1.1/24", del: true}, trig: true},
+		{addr: &addrEvent{index: 1, cidr: "192.168.1.1/24", del: true}},
+	}
+	for i, e := range events {
+		var trig bool
+		if l := e.link; l != nil {
+			attrs := netlink.LinkAttrs{Index: l.index, OperState: netlink.OperDown}
+			if l.up {
+				attrs.Flags = net.FlagUp
+				attrs.OperState = netlink.OperUp
+			}
+			var link netlink.Link = &netlink.Dummy{LinkAttrs: attrs}
+			if l.veth {
+				link = &netlink.Veth{LinkAttrs: attrs}
+			}
+			u := netlink.LinkUpdate{Link: link}
+			u.Header.Type = unix.RTM_NEWLINK
+			if l.del {
+				u.Header.Type = unix.RTM_DELLINK
+			}
+			trig = m.link(&u)
+		} else {
+			ip, ipNet, err := net.ParseCIDR(e.addr.cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ipNet.IP = ip
+			trig = m.addr(&netlink.AddrUpdate{
+				LinkAddress: *ipNet, LinkIndex: e.addr.index, NewAddr: !e.addr.del})
+		}
+		if trig != e.trig {
+			t.Errorf("Event %d: expected %v", i, e.trig)
+		}
+	}
+}
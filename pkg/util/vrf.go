@@ -0,0 +1,84 @@
+/*
+  SPDX-License-Identifier: Apache-2.0
+  Copyright (c) 2019-2023 Nordix Foundation
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/vishvananda/netlink"
+)
+
+// SetupVrf Ensure that a VRF device with the passed routing table
+// exists and is up, and that the passed interfaces are enslaved to
+// it. Interfaces that doesn't exist (yet) are skipped, so this
+// function should be called again later. The VRF is not removed by
+// the daemon since that would break POD traffic on restarts.
+func SetupVrf(
+	ctx context.Context, name string, table int, interfaces []string) error {
+	logger := logr.FromContextOrDiscard(ctx)
+	if table == 0 {
+		return fmt.Errorf("No table for VRF %s", name)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return err
+		}
+		logger.Info("Create VRF", "name", name, "table", table)
+		err = netlink.LinkAdd(&netlink.Vrf{
+			LinkAttrs: netlink.LinkAttrs{Name: name},
+			Table:     uint32(table),
+		})
+		if err != nil {
+			return err
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			return err
+		}
+	}
+	vrf, ok := link.(*netlink.Vrf)
+	if !ok {
+		return fmt.Errorf("Not a VRF %s", name)
+	}
+	if int(vrf.Table) != table {
+		return fmt.Errorf("VRF %s has table %d, expected %d",
+			name, vrf.Table, table)
+	}
+	if err := netlink.LinkSetUp(vrf); err != nil {
+		return err
+	}
+
+	for _, i := range interfaces {
+		l, err := netlink.LinkByName(i)
+		if err != nil {
+			logger.V(1).Info("VRF interface not found", "interface", i)
+			continue
+		}
+		if l.Attrs().MasterIndex == vrf.Attrs().Index {
+			continue
+		}
+		logger.Info("Enslave to VRF", "interface", i, "vrf", name)
+		if err := netlink.LinkSetMaster(l, vrf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VrfTable Returns the routing table of a VRF device
+func VrfTable(name string) (int, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, err
+	}
+	vrf, ok := link.(*netlink.Vrf)
+	if !ok {
+		return 0, fmt.Errorf("Not a VRF %s", name)
+	}
+	return int(vrf.Table), nil
+}